@@ -0,0 +1,217 @@
+package admin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/connection"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/messages"
+	"go.uber.org/zap"
+)
+
+// Client sends administrative requests to a broker. Requests are sent one
+// at a time and each call waits for its response
+type Client struct {
+	conn          net.Conn
+	correlationId uint64
+	lock          sync.Mutex
+	logger        *zap.Logger
+}
+
+func New(conn net.Conn, logger logging.Logger) *Client {
+	return &Client{
+		conn:   conn,
+		logger: logging.Zap(logger),
+	}
+}
+
+// SetPartitionFrozen freezes or unfreezes a partition. Produces to frozen
+// partitions are rejected with an error
+func (c *Client) SetPartitionFrozen(partition string, frozen bool) error {
+	payload := make([]byte, 0, 2+len(partition)+1)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(partition)))
+	payload = append(payload, []byte(partition)...)
+	if frozen {
+		payload = append(payload, 1)
+	} else {
+		payload = append(payload, 0)
+	}
+	_, err := c.roundTrip(connection.RequestTypeSetPartitionFrozen, connection.ResponseTypeOk, payload)
+	return err
+}
+
+// HandoffPartition freezes the partition and returns once all acked batches
+// are durable on disk
+func (c *Client) HandoffPartition(partition string) error {
+	payload := make([]byte, 0, 2+len(partition))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(partition)))
+	payload = append(payload, []byte(partition)...)
+	_, err := c.roundTrip(connection.RequestTypeHandoffPartition, connection.ResponseTypeOk, payload)
+	return err
+}
+
+func (c *Client) PartitionOffsets(partition string) (messages.PartitionOffsets, error) {
+	payload := make([]byte, 0, 2+len(partition))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(partition)))
+	payload = append(payload, []byte(partition)...)
+	response, err := c.roundTrip(connection.RequestTypePartitionOffsets, connection.ResponseTypePartitionOffsets, payload)
+	if err != nil {
+		return messages.PartitionOffsets{}, err
+	}
+	if len(response) != 3*8 {
+		return messages.PartitionOffsets{}, fmt.Errorf("expected 24 bytes of offsets, got %d", len(response))
+	}
+	return messages.PartitionOffsets{
+		LogStart:      binary.BigEndian.Uint64(response),
+		HighWatermark: binary.BigEndian.Uint64(response[8:]),
+		LastStable:    binary.BigEndian.Uint64(response[16:]),
+	}, nil
+}
+
+// SampleRecords returns up to count of the most recent records of the
+// partition, with payloads truncated to maxBytes unless it's 0
+func (c *Client) SampleRecords(partition string, count uint32, maxBytes uint32) ([]messages.SampledRecord, error) {
+	payload := make([]byte, 0, 2+len(partition)+4+4)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(partition)))
+	payload = append(payload, []byte(partition)...)
+	payload = binary.BigEndian.AppendUint32(payload, count)
+	payload = binary.BigEndian.AppendUint32(payload, maxBytes)
+	response, err := c.roundTrip(connection.RequestTypeSampleRecords, connection.ResponseTypeSampledRecords, payload)
+	if err != nil {
+		return nil, err
+	}
+	offset, bytesUsed, err := messages.NextUInt64(response)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing first offset: %v", err)
+	}
+	records := []messages.SampledRecord{}
+	iterator := messages.NewBatchIterator(response[bytesUsed:])
+	for iterator.Next() {
+		record := iterator.Message()
+		if len(record) < 4 {
+			return nil, fmt.Errorf("record at offset %d too short to contain its size", offset)
+		}
+		records = append(records, messages.SampledRecord{
+			Offset:  offset,
+			Size:    binary.BigEndian.Uint32(record),
+			Payload: record[4:],
+		})
+		offset++
+	}
+	if iterator.Err() != nil {
+		return nil, fmt.Errorf("error parsing records: %v", iterator.Err())
+	}
+	return records, nil
+}
+
+// Clients lists the connections open on the broker, including this one
+func (c *Client) Clients() ([]messages.ClientInfo, error) {
+	response, err := c.roundTrip(connection.RequestTypeListClients, connection.ResponseTypeClients, nil)
+	if err != nil {
+		return nil, err
+	}
+	clients := []messages.ClientInfo{}
+	iterator := messages.NewBatchIterator(response)
+	for iterator.Next() {
+		client, err := parseClientInfo(iterator.Message(), c.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing client %d: %v", len(clients), err)
+		}
+		clients = append(clients, client)
+	}
+	if iterator.Err() != nil {
+		return nil, fmt.Errorf("error parsing clients: %v", iterator.Err())
+	}
+	return clients, nil
+}
+
+// EnableCompression asks the broker to compress large responses on this
+// connection
+func (c *Client) EnableCompression() error {
+	payload := make([]byte, 0, 2+len(messages.CodecGzip))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(messages.CodecGzip)))
+	payload = append(payload, []byte(messages.CodecGzip)...)
+	_, err := c.roundTrip(connection.RequestTypeSetCompression, connection.ResponseTypeOk, payload)
+	return err
+}
+
+func (c *Client) Close() error {
+	c.logger.Debug("Closing admin client")
+	return c.conn.Close()
+}
+
+// roundTrip sends the request and returns the payload of the response,
+// after checking its type and correlation id
+func (c *Client) roundTrip(requestType byte, responseType byte, payload []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.correlationId++
+	requestLen := 1 + 8 + len(payload)
+	request := make([]byte, 0, 4+requestLen)
+	request = binary.BigEndian.AppendUint32(request, uint32(requestLen))
+	request = append(request, requestType)
+	request = binary.BigEndian.AppendUint64(request, c.correlationId)
+	request = append(request, payload...)
+	n, err := c.conn.Write(request)
+	if err != nil {
+		return nil, fmt.Errorf("error writing request to connection, wrote %d of %d bytes: %v", n, len(request), err)
+	}
+	response, err := messages.ProtocolMessage(c.conn, c.logger)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	response, err = messages.Decompress(response)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	if len(response) < 1+8 {
+		return nil, fmt.Errorf("response too short to contain header")
+	}
+	correlationId, _, err := messages.NextUInt64(response[1:])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing correlation id: %v", err)
+	}
+	if correlationId != c.correlationId {
+		return nil, fmt.Errorf("expected response to request %d, got %d", c.correlationId, correlationId)
+	}
+	switch response[0] {
+	case responseType:
+		return response[1+8:], nil
+	case connection.ResponseTypeError:
+		message, _, err := messages.NextString(response[1+8:], c.logger)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing error message: %v", err)
+		}
+		return nil, fmt.Errorf("broker responded with error: %s", message)
+	default:
+		return nil, fmt.Errorf("received unexpected response type %v", response[0])
+	}
+}
+
+func parseClientInfo(b []byte, logger *zap.Logger) (messages.ClientInfo, error) {
+	fields := make([]string, 4)
+	bytesUsedTotal := 0
+	for i := range fields {
+		field, bytesUsed, err := messages.NextString(b[bytesUsedTotal:], logger)
+		if err != nil {
+			return messages.ClientInfo{}, fmt.Errorf("error parsing field %d: %v", i, err)
+		}
+		fields[i] = field
+		bytesUsedTotal += bytesUsed
+	}
+	connected, _, err := messages.NextUInt64(b[bytesUsedTotal:])
+	if err != nil {
+		return messages.ClientInfo{}, fmt.Errorf("error parsing connection time: %v", err)
+	}
+	return messages.ClientInfo{
+		Remote:         fields[0],
+		ClientId:       fields[1],
+		LibraryVersion: fields[2],
+		Host:           fields[3],
+		Connected:      time.Unix(0, int64(connected)),
+	}, nil
+}
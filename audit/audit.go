@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+	"go.uber.org/zap"
+)
+
+const (
+	OperationCreatePartition   = "create_partition"
+	OperationFreezePartition   = "freeze_partition"
+	OperationUnfreezePartition = "unfreeze_partition"
+	OperationHandoffPartition  = "handoff_partition"
+)
+
+type Event struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Partition string    `json:"partition,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Log appends administrative and access events as json lines to a
+// dedicated file
+type Log struct {
+	file    *os.File
+	encoder *json.Encoder
+	clock   clock.Clock
+	lock    sync.Mutex
+	logger  *zap.Logger
+}
+
+func New(path string, c clock.Clock, logger *zap.Logger) (*Log, error) {
+	logger.Info("Opening audit log", zap.String("file", path))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &Log{
+		file:    file,
+		encoder: json.NewEncoder(file),
+		clock:   c,
+		logger:  logger,
+	}, nil
+}
+
+func (l *Log) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = l.clock.Now()
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.encoder.Encode(e)
+	if err != nil {
+		l.logger.Error("Failed to write audit event", zap.String("operation", e.Operation), zap.Error(err))
+	}
+}
+
+func (l *Log) Close() error {
+	l.logger.Debug("Closing audit log", zap.String("file", l.file.Name()))
+	return l.file.Close()
+}
@@ -0,0 +1,361 @@
+package benchmark
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/messages"
+	"github.com/lthiede/cartero/producer"
+	"go.uber.org/zap"
+)
+
+const warmupTimeout = 5 * time.Second
+
+type ProduceConfig struct {
+	Address string
+	// if set, producers connect with Dial instead of dialing Address over
+	// tcp, e.g. to an in process broker
+	Dial       func() (net.Conn, error) `json:"-"`
+	Producers  int
+	Partitions []string
+	// messages per batch
+	BatchSize   int
+	MessageSize int
+	// batches each producer may have waiting for an ack
+	MaxInFlight int
+	// with ModeFireAndForget producers don't wait for acks and there are no
+	// latencies, failed counts the dropped batches
+	Mode producer.Mode
+	// batches per second each producer sends at most, 0 for no limit.
+	// Producers slow down further when the broker throttles them
+	RateLimit float64
+	// the run stops at the first of these conditions that is reached, zero
+	// disables a condition. Messages and bytes count what was produced
+	// across all producers
+	Duration    time.Duration
+	MaxMessages uint64
+	MaxBytes    uint64
+	// seeds the message content, producer i uses Seed+i. Runs with the same
+	// config and seed produce the same bytes
+	Seed int64
+	// time source for latencies and the duration, the system clock if nil
+	Clock clock.Clock `json:"-"`
+	// if set, cpu and heap profiles of the broker serving pprof at
+	// BrokerDebugURL are captured during the run and written to ProfileDir
+	BrokerDebugURL string
+	ProfileDir     string
+}
+
+type ProduceMetrics struct {
+	Duration time.Duration
+	Batches  uint64
+	Messages uint64
+	Bytes    uint64
+	Failed   uint64
+	// acks with a throttle hint from the broker
+	Throttled uint64
+	// time from calling Produce until the ack arrived, one per acked batch
+	Latencies []time.Duration
+	sorted    bool
+	// socket stats of each producer's connection at the end of the run,
+	// empty where they couldn't be read
+	Sockets []producer.SocketStats
+}
+
+// Throughput returns the acked payload bytes per second, or the sent bytes
+// in fire and forget mode. It's 0 if no time passed, e.g. with a fake clock
+func (m *ProduceMetrics) Throughput() float64 {
+	if m.Duration <= 0 {
+		return 0
+	}
+	return float64(m.Bytes) / m.Duration.Seconds()
+}
+
+// Percentile returns the ack latency below which p percent of batches were
+// acked
+func (m *ProduceMetrics) Percentile(p float64) time.Duration {
+	if len(m.Latencies) == 0 {
+		return 0
+	}
+	m.sort()
+	i := int(p / 100 * float64(len(m.Latencies)))
+	if i >= len(m.Latencies) {
+		i = len(m.Latencies) - 1
+	}
+	return m.Latencies[i]
+}
+
+// Histogram counts the latencies up to each bound, the last count is for
+// latencies above all bounds. bounds have to be ascending
+func (m *ProduceMetrics) Histogram(bounds []time.Duration) []uint64 {
+	m.sort()
+	counts := make([]uint64, len(bounds)+1)
+	i := 0
+	for _, l := range m.Latencies {
+		for i < len(bounds) && l > bounds[i] {
+			i++
+		}
+		counts[i]++
+	}
+	return counts
+}
+
+func (m *ProduceMetrics) sort() {
+	if m.sorted {
+		return
+	}
+	sort.Slice(m.Latencies, func(i, j int) bool { return m.Latencies[i] < m.Latencies[j] })
+	m.sorted = true
+}
+
+// RunProduce produces batches against the broker until a stop condition is
+// reached and returns the metrics of all producers once all acks arrived. It
+// can be called from go benchmarks as well as from the standalone benchmark
+// binary
+func RunProduce(config ProduceConfig, l logging.Logger) (*ProduceMetrics, error) {
+	logger := logging.Zap(l)
+	if l == nil {
+		l = logging.FromZap(logger)
+	}
+	if config.Producers < 1 || len(config.Partitions) == 0 || config.BatchSize < 1 || config.MaxInFlight < 1 {
+		return nil, fmt.Errorf("invalid config, need at least one producer, partition, message per batch and batch in flight")
+	}
+	if config.Duration == 0 && config.MaxMessages == 0 && config.MaxBytes == 0 {
+		return nil, fmt.Errorf("invalid config, need at least one stop condition")
+	}
+	if config.BrokerDebugURL != "" && config.Duration == 0 {
+		return nil, fmt.Errorf("invalid config, profiling the broker needs a duration")
+	}
+	if config.Clock == nil {
+		config.Clock = clock.System{}
+	}
+	if config.Dial == nil {
+		config.Dial = func() (net.Conn, error) {
+			return net.Dial("tcp", config.Address)
+		}
+	}
+	producers, err := dialProducers(config, l)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Start produce benchmark", zap.Int("producers", config.Producers), zap.Strings("partitions", config.Partitions), zap.Duration("duration", config.Duration), zap.Uint64("maxMessages", config.MaxMessages), zap.Uint64("maxBytes", config.MaxBytes), zap.Int64("seed", config.Seed))
+	metrics := &ProduceMetrics{}
+	var metricsLock sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, config.Producers)
+	profilingDone := make(chan error, 1)
+	start := config.Clock.Now()
+	stop := &stopCondition{
+		clock:       config.Clock,
+		maxMessages: config.MaxMessages,
+		maxBytes:    config.MaxBytes,
+	}
+	if config.Duration > 0 {
+		stop.deadline = start.Add(config.Duration)
+	}
+	if config.BrokerDebugURL != "" {
+		go func() {
+			profilingDone <- captureProfiles(config.BrokerDebugURL, config.ProfileDir, config.Duration)
+		}()
+	} else {
+		profilingDone <- nil
+	}
+	for i := 0; i < config.Producers; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			m, err := runProducer(index, producers[index], config, stop, l)
+			if err != nil {
+				errs <- fmt.Errorf("producer %d failed: %v", index, err)
+				return
+			}
+			metricsLock.Lock()
+			defer metricsLock.Unlock()
+			metrics.Batches += m.Batches
+			metrics.Messages += m.Messages
+			metrics.Bytes += m.Bytes
+			metrics.Failed += m.Failed
+			metrics.Throttled += m.Throttled
+			metrics.Latencies = append(metrics.Latencies, m.Latencies...)
+			metrics.Sockets = append(metrics.Sockets, m.Sockets...)
+		}(i)
+	}
+	wg.Wait()
+	metrics.Duration = config.Clock.Since(start)
+	close(errs)
+	for err := range errs {
+		return nil, err
+	}
+	err = <-profilingDone
+	if err != nil {
+		return nil, fmt.Errorf("error profiling broker: %v", err)
+	}
+	logger.Info("Finished produce benchmark", zap.Uint64("batches", metrics.Batches), zap.Float64("bytesPerSecond", metrics.Throughput()))
+	return metrics, nil
+}
+
+// stopCondition is shared by all producers of a run
+type stopCondition struct {
+	clock       clock.Clock
+	deadline    time.Time
+	maxMessages uint64
+	maxBytes    uint64
+	messages    atomic.Uint64
+	bytes       atomic.Uint64
+}
+
+// reserve claims the next batch and returns false once a stop condition is
+// reached
+func (s *stopCondition) reserve(messages uint64, bytes uint64) bool {
+	if !s.deadline.IsZero() && !s.clock.Now().Before(s.deadline) {
+		return false
+	}
+	if s.maxMessages > 0 && s.messages.Add(messages) > s.maxMessages {
+		return false
+	}
+	if s.maxBytes > 0 && s.bytes.Add(bytes) > s.maxBytes {
+		return false
+	}
+	return true
+}
+
+// dialProducers connects and warms up all producers before the run starts,
+// so connection setup isn't part of the measurement
+func dialProducers(config ProduceConfig, l logging.Logger) ([]*producer.Producer, error) {
+	producers := make([]*producer.Producer, 0, config.Producers)
+	closeAll := func() {
+		for _, p := range producers {
+			p.Close()
+		}
+	}
+	for i := 0; i < config.Producers; i++ {
+		conn, err := config.Dial()
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error starting connection of producer %d: %v", i, err)
+		}
+		producers = append(producers, producer.New(conn, producer.WithMode(config.Mode), producer.WithClock(config.Clock), producer.WithLogger(l), producer.WithClientId(fmt.Sprintf("cartero-bench-%d", i)), producer.WithRateLimit(config.RateLimit)))
+	}
+	for i, p := range producers {
+		err := p.Warm(warmupTimeout)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("error warming up producer %d: %v", i, err)
+		}
+	}
+	return producers, nil
+}
+
+func runProducer(index int, p *producer.Producer, config ProduceConfig, stop *stopCondition, l logging.Logger) (*ProduceMetrics, error) {
+	if config.Mode == producer.ModeFireAndForget {
+		return runFireAndForget(index, p, config, stop, l)
+	}
+	inFlight := make(chan int, config.MaxInFlight)
+	metrics := &ProduceMetrics{}
+	ackingDone := make(chan int)
+	go func() {
+		defer close(ackingDone)
+		for ack := range p.Acks() {
+			<-inFlight
+			collectAck(metrics, ack, config)
+		}
+	}()
+	batch := newBatch(index, config)
+	var batchId uint64
+	for stop.reserve(uint64(config.BatchSize), uint64(config.BatchSize*config.MessageSize)) {
+		select {
+		case inFlight <- 1:
+		case <-ackingDone:
+			p.Close()
+			return nil, fmt.Errorf("connection stopped delivering acks")
+		}
+		partition := config.Partitions[int(batchId)%len(config.Partitions)]
+		err := p.Produce(partition, batchId, batch)
+		if err != nil {
+			p.Close()
+			<-ackingDone
+			return nil, fmt.Errorf("error producing batch %d: %v", batchId, err)
+		}
+		batchId++
+	}
+	// wait for the outstanding acks
+	for i := 0; i < config.MaxInFlight; i++ {
+		select {
+		case inFlight <- 1:
+		case <-ackingDone:
+			p.Close()
+			return nil, fmt.Errorf("connection stopped delivering acks")
+		}
+	}
+	socket, err := p.SocketStats()
+	if err != nil {
+		l.Warn("Error reading socket stats", "index", index, "error", err)
+	} else {
+		metrics.Sockets = append(metrics.Sockets, socket)
+	}
+	err = p.Close()
+	<-ackingDone
+	if err != nil {
+		l.Warn("Error closing producer", "index", index, "error", err)
+	}
+	return metrics, nil
+}
+
+func runFireAndForget(index int, p *producer.Producer, config ProduceConfig, stop *stopCondition, l logging.Logger) (*ProduceMetrics, error) {
+	batch := newBatch(index, config)
+	var batchId uint64
+	for stop.reserve(uint64(config.BatchSize), uint64(config.BatchSize*config.MessageSize)) {
+		partition := config.Partitions[int(batchId)%len(config.Partitions)]
+		err := p.Produce(partition, batchId, batch)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("error producing batch %d: %v", batchId, err)
+		}
+		batchId++
+	}
+	// waits until the queued batches are written
+	err := p.Close()
+	if err != nil {
+		l.Warn("Error closing producer", "index", index, "error", err)
+	}
+	pm := p.Metrics()
+	return &ProduceMetrics{
+		Batches:   pm.Sent,
+		Messages:  pm.Sent * uint64(config.BatchSize),
+		Bytes:     pm.Sent * uint64(config.BatchSize*config.MessageSize),
+		Failed:    pm.Dropped,
+		Throttled: pm.Throttled,
+	}, nil
+}
+
+func newBatch(index int, config ProduceConfig) [][]byte {
+	random := rand.New(rand.NewSource(config.Seed + int64(index)))
+	batch := make([][]byte, config.BatchSize)
+	for i := range batch {
+		batch[i] = make([]byte, config.MessageSize)
+		random.Read(batch[i])
+	}
+	return batch
+}
+
+func collectAck(metrics *ProduceMetrics, ack messages.ProduceAck, config ProduceConfig) {
+	if ack.Throttle > 0 {
+		metrics.Throttled++
+	}
+	if ack.Err != nil {
+		metrics.Failed++
+		return
+	}
+	metrics.Batches++
+	metrics.Messages += uint64(config.BatchSize)
+	metrics.Bytes += uint64(config.BatchSize * config.MessageSize)
+	l := ack.Latency
+	metrics.Latencies = append(metrics.Latencies, l.ClientQueue+l.Network+l.BrokerQueue+l.Append)
+}
@@ -0,0 +1,38 @@
+package benchmark
+
+import (
+	"testing"
+
+	"github.com/lthiede/cartero/inproc"
+)
+
+func BenchmarkProduce(b *testing.B) {
+	broker, err := inproc.NewBroker(b.TempDir(), nil)
+	if err != nil {
+		b.Fatalf("error starting broker: %v", err)
+	}
+	defer broker.Close()
+	config := ProduceConfig{
+		Dial:        broker.Dial,
+		Producers:   3,
+		Partitions:  []string{"partition0", "partition1", "partition2"},
+		BatchSize:   10,
+		MessageSize: 1024,
+		MaxInFlight: 8,
+		// one batch per iteration
+		MaxMessages: uint64(b.N) * 10,
+		Seed:        1,
+	}
+	b.SetBytes(int64(config.BatchSize * config.MessageSize))
+	b.ResetTimer()
+	metrics, err := RunProduce(config, nil)
+	if err != nil {
+		b.Fatalf("error running benchmark: %v", err)
+	}
+	b.StopTimer()
+	if metrics.Failed > 0 {
+		b.Fatalf("%d batches failed", metrics.Failed)
+	}
+	b.ReportMetric(metrics.Throughput(), "bytes/s")
+	b.ReportMetric(float64(metrics.Percentile(99).Nanoseconds()), "p99-ns")
+}
@@ -0,0 +1,52 @@
+package benchmark
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// captureProfiles records a cpu profile of the broker for duration and
+// afterwards a heap profile. The broker has to serve net/http/pprof at
+// debugURL. The profiles are written to cpu.pprof and heap.pprof in dir
+func captureProfiles(debugURL string, dir string, duration time.Duration) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating profile directory: %v", err)
+	}
+	seconds := int(math.Ceil(duration.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	err = download(fmt.Sprintf("%s/debug/pprof/profile?seconds=%d", debugURL, seconds), filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return fmt.Errorf("error capturing cpu profile: %v", err)
+	}
+	err = download(fmt.Sprintf("%s/debug/pprof/heap", debugURL), filepath.Join(dir, "heap.pprof"))
+	if err != nil {
+		return fmt.Errorf("error capturing heap profile: %v", err)
+	}
+	return nil
+}
+
+func download(url string, path string) error {
+	response, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, response.Body)
+	return err
+}
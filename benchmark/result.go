@@ -0,0 +1,59 @@
+package benchmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Result is the summary of a produce benchmark run as written to result
+// files
+type Result struct {
+	Config         ProduceConfig `json:"config"`
+	Duration       time.Duration `json:"duration"`
+	Messages       uint64        `json:"messages"`
+	Failed         uint64        `json:"failed"`
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+	P50            time.Duration `json:"p50"`
+	P99            time.Duration `json:"p99"`
+	Max            time.Duration `json:"max"`
+}
+
+func (m *ProduceMetrics) Result(config ProduceConfig) Result {
+	return Result{
+		Config:         config,
+		Duration:       m.Duration,
+		Messages:       m.Messages,
+		Failed:         m.Failed,
+		BytesPerSecond: m.Throughput(),
+		P50:            m.Percentile(50),
+		P99:            m.Percentile(99),
+		Max:            m.Percentile(100),
+	}
+}
+
+func WriteResult(path string, r Result) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding result: %v", err)
+	}
+	err = os.WriteFile(path, append(b, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing result file: %v", err)
+	}
+	return nil
+}
+
+func ReadResult(path string) (Result, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Result{}, fmt.Errorf("error reading result file: %v", err)
+	}
+	var r Result
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return Result{}, fmt.Errorf("error decoding result file %s: %v", path, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,149 @@
+package benchmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/procstats"
+	"go.uber.org/zap"
+)
+
+// a resource counts as leaking if its average grows in every window and
+// the last window is this much above the first
+const (
+	leakWindows = 4
+	leakGrowth  = 1.1
+)
+
+type SoakConfig struct {
+	Produce ProduceConfig
+	// how often client and broker resources are sampled
+	Interval time.Duration
+	// if set, broker resources are read from the expvars the broker serves
+	// at BrokerDebugURL
+	BrokerDebugURL string
+}
+
+type SoakSample struct {
+	Time   time.Time
+	Client procstats.Stats
+	Broker procstats.Stats
+}
+
+type SoakResult struct {
+	Produce *ProduceMetrics
+	Samples []SoakSample
+	// descriptions of the resources that grew steadily over the run
+	Leaks []string
+}
+
+// RunSoak runs a produce benchmark, usually for hours, while sampling the
+// resources held by the benchmark and the broker to detect slow leaks
+func RunSoak(config SoakConfig, l logging.Logger) (*SoakResult, error) {
+	logger := logging.Zap(l)
+	if config.Interval <= 0 {
+		return nil, fmt.Errorf("invalid config, need a positive sample interval")
+	}
+	if config.Produce.Clock == nil {
+		config.Produce.Clock = clock.System{}
+	}
+	c := config.Produce.Clock
+	result := &SoakResult{}
+	done := make(chan int)
+	sampled := make(chan int)
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-c.After(config.Interval):
+				sample := SoakSample{
+					Time:   c.Now(),
+					Client: procstats.Sample(),
+				}
+				if config.BrokerDebugURL != "" {
+					broker, err := brokerStats(config.BrokerDebugURL)
+					if err != nil {
+						logger.Warn("Error reading broker stats", zap.Error(err))
+					}
+					sample.Broker = broker
+				}
+				logger.Info("Soak sample",
+					zap.Uint64("clientRSS", sample.Client.RSS), zap.Int("clientGoroutines", sample.Client.Goroutines), zap.Int("clientOpenFiles", sample.Client.OpenFiles),
+					zap.Uint64("brokerRSS", sample.Broker.RSS), zap.Int("brokerGoroutines", sample.Broker.Goroutines), zap.Int("brokerOpenFiles", sample.Broker.OpenFiles))
+				result.Samples = append(result.Samples, sample)
+			case <-done:
+				return
+			}
+		}
+	}()
+	metrics, err := RunProduce(config.Produce, l)
+	close(done)
+	<-sampled
+	if err != nil {
+		return nil, err
+	}
+	result.Produce = metrics
+	result.Leaks = detectLeaks(result.Samples)
+	return result, nil
+}
+
+func brokerStats(debugURL string) (procstats.Stats, error) {
+	response, err := http.Get(debugURL + "/debug/vars")
+	if err != nil {
+		return procstats.Stats{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return procstats.Stats{}, fmt.Errorf("%s/debug/vars returned %s", debugURL, response.Status)
+	}
+	var vars struct {
+		Process procstats.Stats `json:"process"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&vars)
+	if err != nil {
+		return procstats.Stats{}, fmt.Errorf("error decoding expvars: %v", err)
+	}
+	return vars.Process, nil
+}
+
+func detectLeaks(samples []SoakSample) []string {
+	if len(samples) < leakWindows {
+		return nil
+	}
+	series := []struct {
+		name  string
+		value func(SoakSample) float64
+	}{
+		{"client rss", func(s SoakSample) float64 { return float64(s.Client.RSS) }},
+		{"client goroutines", func(s SoakSample) float64 { return float64(s.Client.Goroutines) }},
+		{"client open files", func(s SoakSample) float64 { return float64(s.Client.OpenFiles) }},
+		{"broker rss", func(s SoakSample) float64 { return float64(s.Broker.RSS) }},
+		{"broker goroutines", func(s SoakSample) float64 { return float64(s.Broker.Goroutines) }},
+		{"broker open files", func(s SoakSample) float64 { return float64(s.Broker.OpenFiles) }},
+	}
+	leaks := []string{}
+	for _, s := range series {
+		averages := make([]float64, leakWindows)
+		for w := range averages {
+			window := samples[w*len(samples)/leakWindows : (w+1)*len(samples)/leakWindows]
+			for _, sample := range window {
+				averages[w] += s.value(sample)
+			}
+			averages[w] /= float64(len(window))
+		}
+		growing := averages[0] > 0
+		for w := 1; w < leakWindows; w++ {
+			if averages[w] <= averages[w-1] {
+				growing = false
+			}
+		}
+		if growing && averages[leakWindows-1] >= averages[0]*leakGrowth {
+			leaks = append(leaks, fmt.Sprintf("%s grew from %.0f to %.0f on average", s.name, averages[0], averages[leakWindows-1]))
+		}
+	}
+	return leaks
+}
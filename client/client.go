@@ -1,52 +1,95 @@
 package main
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
-	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 
-	"github.com/lthiede/cartero/connection"
-	"github.com/lthiede/cartero/messages"
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/producer"
 	"go.uber.org/zap"
 )
 
+const (
+	dialAttempts      = 30
+	dialRetryInterval = time.Second
+)
+
 func main() {
+	fireAndForget := flag.Bool("fire-and-forget", false, "don't wait for acks, drop batches instead of blocking")
+	flag.Parse()
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		log.Panicf("Error creating logger: %v", err)
 	}
 	defer logger.Sync()
 
+	mode := producer.ModeAcked
+	if *fireAndForget {
+		mode = producer.ModeFireAndForget
+	}
+	breaker := producer.NewBreaker("localhost:8080", 3, 5*time.Second, clock.System{})
 	var wg sync.WaitGroup
 	wg.Add(3)
 	for i := 0; i < 3; i++ {
 		go func(index int) {
-			var swg sync.WaitGroup
-			swg.Add(2)
-			conn, err := net.Dial("tcp", "localhost:8080")
+			defer wg.Done()
+			conn, err := dial(breaker, logger)
 			if err != nil {
-				logger.Panic("Error starting connection", zap.Error(err))
+				logger.Error("Error starting connection", zap.Int("index", index), zap.Error(err))
+				return
 			}
-			defer conn.Close()
-			go produce(index, conn, &swg, logger)
-			go receiveAcks(index, conn, &swg, logger)
+			p := producer.New(conn, producer.WithMode(mode), producer.WithLogger(logging.FromZap(logger)), producer.WithClientId(fmt.Sprintf("client-%d", index)), producer.WithBreaker(breaker))
+			var swg sync.WaitGroup
+			if mode == producer.ModeAcked {
+				swg.Add(1)
+				go receiveAcks(index, p, &swg, logger)
+			}
+			produce(index, p, logger)
 			swg.Wait()
-			wg.Done()
+			socket, err := p.SocketStats()
+			if err != nil {
+				logger.Warn("Error reading socket stats", zap.Error(err))
+			}
+			err = p.Close()
+			if err != nil {
+				logger.Error("Error closing producer", zap.Error(err))
+			}
+			metrics := p.Metrics()
+			logger.Info("Producer metrics", zap.Int("index", index), zap.Uint64("sent", metrics.Sent), zap.Uint64("dropped", metrics.Dropped), zap.Uint64("acked", metrics.Acked), zap.Uint64("failed", metrics.Failed),
+				zap.Duration("rtt", socket.RTT), zap.Duration("rttVar", socket.RTTVar), zap.Uint32("retransmits", socket.Retransmits), zap.Uint32("cwnd", socket.CongestionWindow))
 		}(i)
 	}
 	wg.Wait()
 	logger.Info("Client finished")
 }
 
-func produce(index int, conn net.Conn, wg *sync.WaitGroup, logger *zap.Logger) {
-	defer wg.Done()
+// dial retries until the broker accepts the connection, without dialing
+// while the breaker's circuit is open
+func dial(breaker *producer.Breaker, logger *zap.Logger) (net.Conn, error) {
+	var err error
+	for attempt := 0; attempt < dialAttempts; attempt++ {
+		var conn net.Conn
+		conn, err = breaker.Dial()
+		if err == nil {
+			return conn, nil
+		}
+		if err != producer.ErrCircuitOpen {
+			logger.Warn("Error dialing broker, retrying", zap.Int("attempt", attempt), zap.Error(err))
+		}
+		time.Sleep(dialRetryInterval)
+	}
+	return nil, fmt.Errorf("broker unreachable after %d attempts: %v", dialAttempts, err)
+}
+
+func produce(index int, p *producer.Producer, logger *zap.Logger) {
 	logger.Info("Start producing", zap.Int("index", index))
 	for i := 0; i < 5; i++ {
-		err := produceRequest(index, conn, fmt.Sprintf("partition%d", i%3), uint64(i), []uint32{3, 100, 50, 26}, logger)
+		err := p.Produce(fmt.Sprintf("partition%d", i%3), uint64(i), batch(index, []uint32{3, 100, 50, 26}))
 		if err != nil {
 			logger.Error("Error sending produce request", zap.Error(err))
 			return
@@ -55,65 +98,39 @@ func produce(index int, conn net.Conn, wg *sync.WaitGroup, logger *zap.Logger) {
 	logger.Info("Finished producing", zap.Int("index", index))
 }
 
-func produceRequest(index int, conn net.Conn, partition string, batchId uint64, messageLengths []uint32, logger *zap.Logger) error {
-	payloadLen := 0
-	for _, l := range messageLengths {
-		payloadLen += 4 + int(l)
-	}
-	partitionNameLen := 2 + len(partition)
-	requestLengthEncodingLen := 4
-	requestTypeEncodingLen := 1
-	batchIdEncodingLen := 8
-	var requestLen uint32 = uint32(requestTypeEncodingLen + partitionNameLen + batchIdEncodingLen + payloadLen)
-	request := make([]byte, 0, int(requestLen)+requestLengthEncodingLen)
-	request = binary.BigEndian.AppendUint32(request, uint32(requestLen))
-	request = append(request, connection.RequestTypeProduce)
-	request = binary.BigEndian.AppendUint16(request, uint16(len(partition)))
-	request = append(request, []byte(partition)...)
-	request = binary.BigEndian.AppendUint64(request, uint64(batchId))
+func batch(index int, messageLengths []uint32) [][]byte {
+	batch := make([][]byte, 0, len(messageLengths))
 	for message, messageLength := range messageLengths {
-		request = binary.BigEndian.AppendUint32(request, messageLength)
-		for j := 0; j < int(messageLength); j++ {
-			request = append(request, byte(j*message*index))
+		m := make([]byte, messageLength)
+		for j := range m {
+			m[j] = byte(j * message * index)
 		}
+		batch = append(batch, m)
 	}
-	if logger.Level() == zap.DebugLevel {
-		hasher := sha1.New()
-		hasher.Write(request[4:])
-		sha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-		logger.Debug("Write request", zap.String("sha", sha), zap.ByteString("request", request))
-	}
-	n, err := conn.Write(request)
-	if err != nil {
-		return fmt.Errorf("error writing request to connection, wrote %d of %d bytes: %v", n, requestLen+uint32(requestLengthEncodingLen), err)
-	}
-	return nil
+	return batch
 }
 
-func receiveAcks(index int, conn net.Conn, wg *sync.WaitGroup, logger *zap.Logger) {
+func receiveAcks(index int, p *producer.Producer, wg *sync.WaitGroup, logger *zap.Logger) {
 	defer wg.Done()
 	logger.Info("Start receiving acks", zap.Int("index", index))
 	for i := 0; i < 5; i++ {
-		response, err := messages.ProtocolMessage(conn, logger)
-		if err != nil {
-			logger.Error("Error reading response", zap.Error(err))
-			return
-		}
-		if response[0] == connection.ResponseTypeAckProduce {
-			logger.Info("Received ack")
-		} else {
-			logger.Error("Received unrecognized response type")
+		ack, ok := <-p.Acks()
+		if !ok {
+			logger.Error("Connection stopped delivering acks")
 			return
 		}
-		partition, bytesUsed, err := messages.NextString(response, logger)
-		if err != nil {
-			logger.Error("Error parsing partition name", zap.Error(err))
-		}
-		batchId, _, err := messages.NextUInt64(response[bytesUsed:])
-		if err != nil {
-			logger.Error("Error parsing batchId", zap.Error(err))
+		if ack.Err != nil {
+			logger.Error("Batch failed", zap.Uint64("correlationId", ack.CorrelationId), zap.Uint64("batchId", ack.BatchId), zap.String("partition", ack.PartitionName), zap.Error(ack.Err))
+			continue
 		}
-		logger.Info("Received ack of batch", zap.Uint64("batchId", batchId), zap.String("partition", partition))
+		logger.Info("Received ack of batch",
+			zap.Uint64("correlationId", ack.CorrelationId),
+			zap.Uint64("batchId", ack.BatchId),
+			zap.String("partition", ack.PartitionName),
+			zap.Duration("clientQueue", ack.Latency.ClientQueue),
+			zap.Duration("network", ack.Latency.Network),
+			zap.Duration("brokerQueue", ack.Latency.BrokerQueue),
+			zap.Duration("append", ack.Latency.Append))
 	}
 	logger.Info("Finished receiving acks", zap.Int("Index", index))
 }
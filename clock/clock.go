@@ -0,0 +1,93 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source for latency measurements and deadlines, so they
+// can be controlled in tests
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// After delivers the time once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// System reads the system clock. Its times include the monotonic clock
+// reading, so durations between them aren't affected by wall clock changes
+type System struct{}
+
+func (System) Now() time.Time {
+	return time.Now()
+}
+
+func (System) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (System) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake only moves when it's told to
+type Fake struct {
+	now     time.Time
+	waiters []waiter
+	lock    sync.Mutex
+}
+
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+// After fires once the fake is advanced or set to at least d from now
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	c := make(chan time.Time, 1)
+	f.waiters = append(f.waiters, waiter{f.now.Add(d), c})
+	f.fireLocked()
+	return c
+}
+
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+	f.fireLocked()
+}
+
+func (f *Fake) Set(now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = now
+	f.fireLocked()
+}
+
+func (f *Fake) fireLocked() {
+	waiting := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.c <- f.now
+		}
+	}
+	f.waiters = waiting
+}
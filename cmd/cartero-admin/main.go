@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/lthiede/cartero/admin"
+)
+
+const usage = `Usage: cartero-admin [-address host:port] <command> [arguments]
+
+Commands:
+  freeze <partition>    reject produces to the partition
+  unfreeze <partition>  accept produces to the partition again
+  handoff <partition>...
+                        freeze the partitions and wait until they are durable,
+                        before planned maintenance
+  offsets <partition>   print log start offset, high watermark and last stable offset
+  clients               list connected clients and the metadata they reported
+  sample <partition> [count] [max-bytes]
+                        hex dump the last count records, 10 by default, with
+                        payloads truncated to max-bytes, 64 by default and 0
+                        for complete payloads
+`
+
+func main() {
+	address := flag.String("address", "localhost:8080", "address of the broker")
+	compress := flag.Bool("compress", false, "ask the broker to compress large responses")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	conn, err := net.Dial("tcp", *address)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to %s: %v\n", *address, err)
+		os.Exit(1)
+	}
+	client := admin.New(conn, nil)
+	defer client.Close()
+	if *compress {
+		err = client.EnableCompression()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error enabling compression: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	err = run(client, flag.Arg(0), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(client *admin.Client, command string, args []string) error {
+	switch command {
+	case "freeze", "unfreeze":
+		if len(args) != 1 {
+			return fmt.Errorf("%s expects exactly one partition", command)
+		}
+		frozen := command == "freeze"
+		err := client.SetPartitionFrozen(args[0], frozen)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Partition %s frozen: %v\n", args[0], frozen)
+		return nil
+	case "handoff":
+		if len(args) == 0 {
+			return fmt.Errorf("handoff expects at least one partition")
+		}
+		for _, partition := range args {
+			err := client.HandoffPartition(partition)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Partition %s handed off, frozen and durable\n", partition)
+		}
+		return nil
+	case "offsets":
+		if len(args) != 1 {
+			return fmt.Errorf("offsets expects exactly one partition")
+		}
+		offsets, err := client.PartitionOffsets(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Partition %s: log start %d, high watermark %d, last stable %d\n", args[0], offsets.LogStart, offsets.HighWatermark, offsets.LastStable)
+		return nil
+	case "clients":
+		if len(args) != 0 {
+			return fmt.Errorf("clients expects no arguments")
+		}
+		clients, err := client.Clients()
+		if err != nil {
+			return err
+		}
+		for _, c := range clients {
+			fmt.Printf("%s: client id %q, library version %q, host %q, connected %s\n", c.Remote, c.ClientId, c.LibraryVersion, c.Host, c.Connected.Format(time.RFC3339))
+		}
+		return nil
+	case "sample":
+		if len(args) < 1 || len(args) > 3 {
+			return fmt.Errorf("sample expects a partition and optionally count and max bytes")
+		}
+		limits := []uint64{10, 64}
+		for i, arg := range args[1:] {
+			limit, err := strconv.ParseUint(arg, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid number %s: %v", arg, err)
+			}
+			limits[i] = limit
+		}
+		records, err := client.SampleRecords(args[0], uint32(limits[0]), uint32(limits[1]))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Partition %s: %d records\n", args[0], len(records))
+		for _, r := range records {
+			truncated := ""
+			if len(r.Payload) < int(r.Size) {
+				truncated = fmt.Sprintf(", showing %d", len(r.Payload))
+			}
+			fmt.Printf("Offset %d: %d bytes%s\n%s", r.Offset, r.Size, truncated, hex.Dump(r.Payload))
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown command %s", command)
+	}
+}
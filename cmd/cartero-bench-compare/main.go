@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lthiede/cartero/benchmark"
+)
+
+const usage = `Usage: cartero-bench-compare [flags] <baseline> <result>...
+
+Compares cartero-bench result files against the baseline and exits with 1 if
+any of them regresses by more than the thresholds.
+`
+
+type metric struct {
+	name string
+	// throughput regresses when it drops, latencies when they grow
+	higherIsBetter bool
+	value          func(benchmark.Result) float64
+}
+
+var metrics = []metric{
+	{"bytes/s", true, func(r benchmark.Result) float64 { return r.BytesPerSecond }},
+	{"p50", false, func(r benchmark.Result) float64 { return float64(r.P50) }},
+	{"p99", false, func(r benchmark.Result) float64 { return float64(r.P99) }},
+	{"max", false, func(r benchmark.Result) float64 { return float64(r.Max) }},
+}
+
+func main() {
+	throughputThreshold := flag.Float64("throughput-threshold", 5, "percent the throughput may drop before it counts as a regression")
+	latencyThreshold := flag.Float64("latency-threshold", 10, "percent a latency percentile may grow before it counts as a regression")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	baseline, err := benchmark.ReadResult(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	regressed := false
+	for _, path := range flag.Args()[1:] {
+		result, err := benchmark.ReadResult(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s against %s\n", path, flag.Arg(0))
+		for _, m := range metrics {
+			threshold := *latencyThreshold
+			if m.higherIsBetter {
+				threshold = *throughputThreshold
+			}
+			before := m.value(baseline)
+			after := m.value(result)
+			delta := 0.0
+			if before != 0 {
+				delta = (after - before) / before * 100
+			}
+			worse := delta > threshold
+			if m.higherIsBetter {
+				worse = -delta > threshold
+			}
+			verdict := "ok"
+			if worse {
+				verdict = "REGRESSION"
+				regressed = true
+			}
+			fmt.Printf("  %-8s %14s %14s %+8.2f%%  %s\n", m.name, format(m, before), format(m, after), delta, verdict)
+		}
+	}
+	if regressed {
+		os.Exit(1)
+	}
+}
+
+func format(m metric, v float64) string {
+	if m.higherIsBetter {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return time.Duration(v).String()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lthiede/cartero/benchmark"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/producer"
+	"go.uber.org/zap"
+)
+
+func main() {
+	address := flag.String("address", "localhost:8080", "address of the broker")
+	producers := flag.Int("producers", 3, "number of producers, each with its own connection")
+	partitions := flag.String("partitions", "partition0,partition1,partition2", "comma separated partitions to produce to")
+	batchSize := flag.Int("batch-size", 10, "messages per batch")
+	messageSize := flag.Int("message-size", 1024, "bytes per message")
+	maxInFlight := flag.Int("max-in-flight", 8, "batches per producer waiting for an ack")
+	rateLimit := flag.Float64("rate-limit", 0, "batches per second each producer sends at most, 0 for no limit. Producers slow down further when the broker throttles them")
+	fireAndForget := flag.Bool("fire-and-forget", false, "don't wait for acks, drop batches instead of blocking")
+	histogram := flag.Bool("histogram", false, "log the distribution of ack latencies")
+	duration := flag.Duration("duration", 10*time.Second, "stop after this duration, 0 to disable")
+	maxMessages := flag.Uint64("max-messages", 0, "stop after producing this many messages, 0 to disable")
+	maxBytes := flag.Uint64("max-bytes", 0, "stop after producing this many payload bytes, 0 to disable")
+	seed := flag.Int64("seed", 1, "seed for the message content, runs with the same flags and seed produce the same bytes")
+	brokerDebugURL := flag.String("broker-debug-url", "", "capture broker profiles from pprof served at this url, e.g. http://localhost:6060")
+	profileDir := flag.String("profile-dir", "profiles", "directory for the captured broker profiles")
+	resultFile := flag.String("result-file", "", "write the result as json to this file, for cartero-bench-compare")
+	soakInterval := flag.Duration("soak-interval", 0, "run as soak test sampling client and broker resources at this interval and fail on steady growth. Broker resources are read from -broker-debug-url, no profiles are captured")
+	flag.Parse()
+	logger, err := zap.NewProduction()
+	if err != nil {
+		log.Panicf("Error creating logger: %v", err)
+	}
+	defer logger.Sync()
+
+	mode := producer.ModeAcked
+	if *fireAndForget {
+		mode = producer.ModeFireAndForget
+	}
+	config := benchmark.ProduceConfig{
+		Address:        *address,
+		Producers:      *producers,
+		Partitions:     strings.Split(*partitions, ","),
+		BatchSize:      *batchSize,
+		MessageSize:    *messageSize,
+		MaxInFlight:    *maxInFlight,
+		Mode:           mode,
+		RateLimit:      *rateLimit,
+		Duration:       *duration,
+		MaxMessages:    *maxMessages,
+		MaxBytes:       *maxBytes,
+		Seed:           *seed,
+		BrokerDebugURL: *brokerDebugURL,
+		ProfileDir:     *profileDir,
+	}
+	var metrics *benchmark.ProduceMetrics
+	leaks := []string{}
+	if *soakInterval > 0 {
+		config.BrokerDebugURL = ""
+		result, err := benchmark.RunSoak(benchmark.SoakConfig{
+			Produce:        config,
+			Interval:       *soakInterval,
+			BrokerDebugURL: *brokerDebugURL,
+		}, logging.FromZap(logger))
+		if err != nil {
+			logger.Fatal("Soak test failed", zap.Error(err))
+		}
+		metrics = result.Produce
+		leaks = result.Leaks
+	} else {
+		metrics, err = benchmark.RunProduce(config, logging.FromZap(logger))
+		if err != nil {
+			logger.Fatal("Benchmark failed", zap.Error(err))
+		}
+	}
+	logger.Info("Produce benchmark result",
+		zap.Duration("duration", metrics.Duration),
+		zap.Uint64("batches", metrics.Batches),
+		zap.Uint64("messages", metrics.Messages),
+		zap.Uint64("failed", metrics.Failed),
+		zap.Uint64("throttled", metrics.Throttled),
+		zap.Float64("bytesPerSecond", metrics.Throughput()),
+		zap.Duration("p50", metrics.Percentile(50)),
+		zap.Duration("p90", metrics.Percentile(90)),
+		zap.Duration("p99", metrics.Percentile(99)),
+		zap.Duration("p999", metrics.Percentile(99.9)),
+		zap.Duration("max", metrics.Percentile(100)))
+	if *histogram {
+		logHistogram(metrics, logger)
+	}
+	for i, s := range metrics.Sockets {
+		logger.Info("Producer socket stats", zap.Int("producer", i), zap.Duration("rtt", s.RTT), zap.Duration("rttVar", s.RTTVar), zap.Uint32("retransmits", s.Retransmits), zap.Uint32("cwnd", s.CongestionWindow))
+	}
+	if *resultFile != "" {
+		err := benchmark.WriteResult(*resultFile, metrics.Result(config))
+		if err != nil {
+			logger.Fatal("Error writing result", zap.Error(err))
+		}
+	}
+	for _, leak := range leaks {
+		logger.Warn("Possible leak", zap.String("resource", leak))
+	}
+	if len(leaks) > 0 {
+		logger.Fatal("Soak test found possible leaks", zap.Int("leaks", len(leaks)))
+	}
+}
+
+// logHistogram logs the ack latencies in buckets doubling from 100µs
+func logHistogram(metrics *benchmark.ProduceMetrics, logger *zap.Logger) {
+	bounds := []time.Duration{}
+	for b := 100 * time.Microsecond; b <= 2*time.Second; b *= 2 {
+		bounds = append(bounds, b)
+	}
+	counts := metrics.Histogram(bounds)
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		bound := "inf"
+		if i < len(bounds) {
+			bound = bounds[i].String()
+		}
+		logger.Info("Ack latency bucket", zap.String("upTo", bound), zap.Uint64("batches", count))
+	}
+}
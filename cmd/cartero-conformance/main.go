@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lthiede/cartero/conformance"
+)
+
+func main() {
+	address := flag.String("address", "localhost:8080", "address of the broker under test")
+	partition := flag.String("partition", "partition0", "existing partition to produce to")
+	flag.Parse()
+	results, err := conformance.Run(*address, *partition)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running conformance checks: %v\n", err)
+		os.Exit(2)
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", r.Name, r.Err)
+		} else {
+			fmt.Printf("PASS %s\n", r.Name)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d checks failed\n", failed, len(results))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Stable C interface of the cartero client, see main.go for how to build the
+shared library. Functions returning int return 0 on success and a negative
+value on failure. The error of the last failed call on a producer can be
+read with cartero_producer_error.
+*/
+
+#ifndef CARTERO_H
+#define CARTERO_H
+
+#include <stdint.h>
+
+typedef uintptr_t cartero_producer;
+
+#define CARTERO_ERROR -1
+#define CARTERO_CLOSED -2
+
+/* Connects to the broker at address, returns 0 if connecting failed */
+cartero_producer cartero_producer_new(char* address);
+
+/* Sends count messages as one batch without waiting for the ack */
+int cartero_produce(cartero_producer p, char* partition, uint64_t batch_id, char** messages, uint32_t* lengths, int count);
+
+/* Blocks until the next ack. Returns CARTERO_ERROR if the broker failed the
+batch and CARTERO_CLOSED if the connection stopped delivering acks */
+int cartero_wait_ack(cartero_producer p, uint64_t* batch_id);
+
+/* Copies the last error into buf, returns the length of the full error */
+int cartero_producer_error(cartero_producer p, char* buf, int len);
+
+void cartero_producer_close(cartero_producer p);
+
+#endif
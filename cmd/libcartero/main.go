@@ -0,0 +1,106 @@
+// libcartero exports the producer as a C shared library for non Go clients.
+// Build it with
+//
+//	go build -buildmode=c-shared -o libcartero.so ./cmd/libcartero
+//
+// and include cartero.h
+package main
+
+/*
+#include <stdlib.h>
+#include <string.h>
+#include "cartero.h"
+*/
+import "C"
+
+import (
+	"net"
+	"runtime/cgo"
+	"sync"
+	"unsafe"
+
+	"github.com/lthiede/cartero/producer"
+)
+
+type handle struct {
+	producer *producer.Producer
+	lastErr  error
+	lock     sync.Mutex
+}
+
+func (h *handle) fail(err error) C.int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastErr = err
+	return C.CARTERO_ERROR
+}
+
+//export cartero_producer_new
+func cartero_producer_new(address *C.char) C.cartero_producer {
+	conn, err := net.Dial("tcp", C.GoString(address))
+	if err != nil {
+		return 0
+	}
+	h := &handle{
+		producer: producer.New(conn),
+	}
+	return C.cartero_producer(cgo.NewHandle(h))
+}
+
+//export cartero_produce
+func cartero_produce(p C.cartero_producer, partition *C.char, batchId C.uint64_t, messages **C.char, lengths *C.uint32_t, count C.int) C.int {
+	h := cgo.Handle(p).Value().(*handle)
+	cMessages := unsafe.Slice(messages, int(count))
+	cLengths := unsafe.Slice(lengths, int(count))
+	batch := make([][]byte, int(count))
+	for i := range batch {
+		batch[i] = C.GoBytes(unsafe.Pointer(cMessages[i]), C.int(cLengths[i]))
+	}
+	err := h.producer.Produce(C.GoString(partition), uint64(batchId), batch)
+	if err != nil {
+		return h.fail(err)
+	}
+	return 0
+}
+
+//export cartero_wait_ack
+func cartero_wait_ack(p C.cartero_producer, batchId *C.uint64_t) C.int {
+	h := cgo.Handle(p).Value().(*handle)
+	ack, ok := <-h.producer.Acks()
+	if !ok {
+		return C.CARTERO_CLOSED
+	}
+	*batchId = C.uint64_t(ack.BatchId)
+	if ack.Err != nil {
+		return h.fail(ack.Err)
+	}
+	return 0
+}
+
+//export cartero_producer_error
+func cartero_producer_error(p C.cartero_producer, buf *C.char, length C.int) C.int {
+	h := cgo.Handle(p).Value().(*handle)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.lastErr == nil || length <= 0 {
+		return 0
+	}
+	message := h.lastErr.Error()
+	n := len(message)
+	if n > int(length)-1 {
+		n = int(length) - 1
+	}
+	out := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(length))
+	copy(out, message[:n])
+	out[n] = 0
+	return C.int(len(message))
+}
+
+//export cartero_producer_close
+func cartero_producer_close(p C.cartero_producer) {
+	ch := cgo.Handle(p)
+	ch.Value().(*handle).producer.Close()
+	ch.Delete()
+}
+
+func main() {}
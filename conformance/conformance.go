@@ -0,0 +1,605 @@
+// Package conformance checks a broker against the wire protocol definition
+// in the protocol package
+package conformance
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/lthiede/cartero/messages"
+	"github.com/lthiede/cartero/protocol"
+)
+
+const responseTimeout = 5 * time.Second
+
+type Result struct {
+	Name string
+	Err  error
+}
+
+type check struct {
+	name string
+	run  func(conn net.Conn, spec *protocol.Spec, partition string) error
+}
+
+var checks = []check{
+	{"produce is acked", produceIsAcked},
+	{"produce to unknown partition returns error", produceToUnknownPartition},
+	{"unknown request type returns error", unknownRequestType},
+	{"unimplemented requests return error", unimplementedRequests},
+	{"malformed request returns error and keeps connection open", malformedRequest},
+	{"pipelined produces are all acked", pipelinedProduces},
+	{"produce to frozen partition returns error", produceToFrozenPartition},
+	{"high watermark advances by the produced messages", highWatermarkAdvances},
+	{"sampled records end with the produced messages", sampledRecordsEndWithProduced},
+	{"reported client metadata is listed", clientMetadataIsListed},
+	{"handoff freezes the partition", handoffPartition},
+	{"large responses are compressed after set compression", largeResponsesAreCompressed},
+}
+
+// Run executes all checks against the broker at address, each on a new
+// connection. partition has to exist on the broker
+func Run(address string, partition string) ([]Result, error) {
+	return RunDial(func() (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}, partition)
+}
+
+// RunDial is Run for brokers that aren't reached over tcp, e.g. in process
+// brokers. dial is called for every check
+func RunDial(dial func() (net.Conn, error), partition string) ([]Result, error) {
+	spec, err := protocol.Load()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		conn, err := dial()
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to broker: %v", err)
+		}
+		err = c.run(conn, spec, partition)
+		conn.Close()
+		results = append(results, Result{c.name, err})
+	}
+	return results, nil
+}
+
+func produceIsAcked(conn net.Conn, spec *protocol.Spec, partition string) error {
+	err := sendProduce(conn, spec, 1, partition, 7)
+	if err != nil {
+		return err
+	}
+	return expectAck(conn, spec, 1, partition, 7)
+}
+
+func produceToUnknownPartition(conn net.Conn, spec *protocol.Spec, partition string) error {
+	err := sendProduce(conn, spec, 2, "conformance-unknown-partition", 0)
+	if err != nil {
+		return err
+	}
+	return expectError(conn, spec, 2)
+}
+
+func unknownRequestType(conn net.Conn, spec *protocol.Spec, partition string) error {
+	request := []byte{0, 0, 0, 9, 255}
+	request = binary.BigEndian.AppendUint64(request, 3)
+	_, err := conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing request: %v", err)
+	}
+	return expectError(conn, spec, 3)
+}
+
+func unimplementedRequests(conn net.Conn, spec *protocol.Spec, partition string) error {
+	for i, name := range []string{"Consume", "CreatePartition"} {
+		message, err := spec.Request(name)
+		if err != nil {
+			return err
+		}
+		correlationId := uint64(60 + i)
+		request, err := message.Encode(map[string]any{"CorrelationId": correlationId})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(request)
+		if err != nil {
+			return fmt.Errorf("error writing %s request: %v", name, err)
+		}
+		err = expectError(conn, spec, correlationId)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func malformedRequest(conn net.Conn, spec *protocol.Spec, partition string) error {
+	produce, err := spec.Request("Produce")
+	if err != nil {
+		return err
+	}
+	// correlation id followed by a partition name length without the name
+	request := []byte{0, 0, 0, 11, produce.Type}
+	request = binary.BigEndian.AppendUint64(request, 4)
+	request = binary.BigEndian.AppendUint16(request, 100)
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing request: %v", err)
+	}
+	err = expectError(conn, spec, 4)
+	if err != nil {
+		return err
+	}
+	err = sendProduce(conn, spec, 5, partition, 8)
+	if err != nil {
+		return err
+	}
+	return expectAck(conn, spec, 5, partition, 8)
+}
+
+func pipelinedProduces(conn net.Conn, spec *protocol.Spec, partition string) error {
+	pending := map[uint64]bool{}
+	for i := uint64(10); i < 20; i++ {
+		err := sendProduce(conn, spec, i, partition, i)
+		if err != nil {
+			return err
+		}
+		pending[i] = true
+	}
+	ack, err := spec.Response("ProduceAck")
+	if err != nil {
+		return err
+	}
+	for len(pending) > 0 {
+		values, err := readResponse(conn, ack)
+		if err != nil {
+			return err
+		}
+		correlationId := values["CorrelationId"].(uint64)
+		if !pending[correlationId] {
+			return fmt.Errorf("unexpected ack for correlation id %d", correlationId)
+		}
+		if values["BatchId"].(uint64) != correlationId {
+			return fmt.Errorf("ack for correlation id %d has batch id %d", correlationId, values["BatchId"])
+		}
+		delete(pending, correlationId)
+	}
+	return nil
+}
+
+func produceToFrozenPartition(conn net.Conn, spec *protocol.Spec, partition string) error {
+	err := setFrozen(conn, spec, 20, partition, 1)
+	if err != nil {
+		return err
+	}
+	err = sendProduce(conn, spec, 21, partition, 21)
+	if err != nil {
+		return err
+	}
+	produceErr := expectError(conn, spec, 21)
+	err = setFrozen(conn, spec, 22, partition, 0)
+	if err != nil {
+		return err
+	}
+	if produceErr != nil {
+		return produceErr
+	}
+	err = sendProduce(conn, spec, 23, partition, 23)
+	if err != nil {
+		return err
+	}
+	return expectAck(conn, spec, 23, partition, 23)
+}
+
+func highWatermarkAdvances(conn net.Conn, spec *protocol.Spec, partition string) error {
+	before, err := partitionOffsets(conn, spec, 30, partition)
+	if err != nil {
+		return err
+	}
+	// sendProduce sends two messages per batch
+	err = sendProduce(conn, spec, 31, partition, 31)
+	if err != nil {
+		return err
+	}
+	err = expectAck(conn, spec, 31, partition, 31)
+	if err != nil {
+		return err
+	}
+	after, err := partitionOffsets(conn, spec, 32, partition)
+	if err != nil {
+		return err
+	}
+	if after["HighWatermark"].(uint64) != before["HighWatermark"].(uint64)+2 {
+		return fmt.Errorf("expected high watermark %d after producing two messages, got %d", before["HighWatermark"].(uint64)+2, after["HighWatermark"])
+	}
+	return nil
+}
+
+func largeResponsesAreCompressed(conn net.Conn, spec *protocol.Spec, partition string) error {
+	setCompression, err := spec.Request("SetCompression")
+	if err != nil {
+		return err
+	}
+	request, err := setCompression.Encode(map[string]any{
+		"CorrelationId": uint64(70),
+		"Codec":         "gzip",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing set compression request: %v", err)
+	}
+	err = expectOk(conn, spec, 70)
+	if err != nil {
+		return err
+	}
+	produce, err := spec.Request("Produce")
+	if err != nil {
+		return err
+	}
+	message := bytes.Repeat([]byte("conformance"), 1000)
+	request, err = produce.Encode(map[string]any{
+		"CorrelationId": uint64(71),
+		"Partition":     partition,
+		"BatchId":       uint64(71),
+		"Messages":      [][]byte{message},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing produce request: %v", err)
+	}
+	err = expectAck(conn, spec, 71, partition, 71)
+	if err != nil {
+		return err
+	}
+	sampleRecords, err := spec.Request("SampleRecords")
+	if err != nil {
+		return err
+	}
+	request, err = sampleRecords.Encode(map[string]any{
+		"CorrelationId":   uint64(72),
+		"Partition":       partition,
+		"Count":           uint32(1),
+		"MaxPayloadBytes": uint32(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing sample records request: %v", err)
+	}
+	frame, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	sampledRecords, err := spec.Response("SampledRecords")
+	if err != nil {
+		return err
+	}
+	if len(frame) == 0 || frame[0] != sampledRecords.Type|messages.FlagCompressed {
+		return fmt.Errorf("expected compressed SampledRecords response, got type %v", frame[:1])
+	}
+	decompressed, err := messages.Decompress(frame)
+	if err != nil {
+		return err
+	}
+	values, err := sampledRecords.Decode(decompressed)
+	if err != nil {
+		return err
+	}
+	records := values["Records"].([][]byte)
+	if values["CorrelationId"] != uint64(72) || len(records) != 1 || !bytes.Equal(records[0][4:], message) {
+		return fmt.Errorf("expected the produced message in the decompressed response, got %v", values)
+	}
+	return nil
+}
+
+func handoffPartition(conn net.Conn, spec *protocol.Spec, partition string) error {
+	err := sendProduce(conn, spec, 60, partition, 60)
+	if err != nil {
+		return err
+	}
+	err = expectAck(conn, spec, 60, partition, 60)
+	if err != nil {
+		return err
+	}
+	handoff, err := spec.Request("HandoffPartition")
+	if err != nil {
+		return err
+	}
+	request, err := handoff.Encode(map[string]any{
+		"CorrelationId": uint64(61),
+		"Partition":     partition,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing handoff partition request: %v", err)
+	}
+	err = expectOk(conn, spec, 61)
+	if err != nil {
+		return err
+	}
+	err = sendProduce(conn, spec, 62, partition, 62)
+	if err != nil {
+		return err
+	}
+	produceErr := expectError(conn, spec, 62)
+	err = setFrozen(conn, spec, 63, partition, 0)
+	if err != nil {
+		return err
+	}
+	return produceErr
+}
+
+func sampledRecordsEndWithProduced(conn net.Conn, spec *protocol.Spec, partition string) error {
+	err := sendProduce(conn, spec, 40, partition, 40)
+	if err != nil {
+		return err
+	}
+	err = expectAck(conn, spec, 40, partition, 40)
+	if err != nil {
+		return err
+	}
+	offsets, err := partitionOffsets(conn, spec, 41, partition)
+	if err != nil {
+		return err
+	}
+	sampleRecords, err := spec.Request("SampleRecords")
+	if err != nil {
+		return err
+	}
+	// truncates the first message of the batch
+	request, err := sampleRecords.Encode(map[string]any{
+		"CorrelationId":   uint64(42),
+		"Partition":       partition,
+		"Count":           uint32(2),
+		"MaxPayloadBytes": uint32(4),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing sample records request: %v", err)
+	}
+	response, err := spec.Response("SampledRecords")
+	if err != nil {
+		return err
+	}
+	values, err := readResponse(conn, response)
+	if err != nil {
+		return err
+	}
+	if values["CorrelationId"] != uint64(42) {
+		return fmt.Errorf("expected sampled records with correlation id 42, got %v", values)
+	}
+	if values["FirstOffset"] != offsets["HighWatermark"].(uint64)-2 {
+		return fmt.Errorf("expected sampled records to start at offset %d, got %v", offsets["HighWatermark"].(uint64)-2, values["FirstOffset"])
+	}
+	records := values["Records"].([][]byte)
+	// every record is its size followed by the payload
+	expected := [][]byte{
+		append(binary.BigEndian.AppendUint32(nil, uint32(len("conformance"))), "conf"...),
+		binary.BigEndian.AppendUint32(nil, 0),
+	}
+	if len(records) != len(expected) || !bytes.Equal(records[0], expected[0]) || !bytes.Equal(records[1], expected[1]) {
+		return fmt.Errorf("expected records %v, got %v", expected, records)
+	}
+	return nil
+}
+
+func clientMetadataIsListed(conn net.Conn, spec *protocol.Spec, partition string) error {
+	clientMetadata, err := spec.Request("ClientMetadata")
+	if err != nil {
+		return err
+	}
+	request, err := clientMetadata.Encode(map[string]any{
+		"CorrelationId":  uint64(50),
+		"ClientId":       "conformance",
+		"LibraryVersion": "v0.0.0",
+		"Host":           "conformance-host",
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing client metadata request: %v", err)
+	}
+	err = expectOk(conn, spec, 50)
+	if err != nil {
+		return err
+	}
+	listClients, err := spec.Request("ListClients")
+	if err != nil {
+		return err
+	}
+	request, err = listClients.Encode(map[string]any{"CorrelationId": uint64(51)})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing list clients request: %v", err)
+	}
+	clients, err := spec.Response("Clients")
+	if err != nil {
+		return err
+	}
+	values, err := readResponse(conn, clients)
+	if err != nil {
+		return err
+	}
+	if values["CorrelationId"] != uint64(51) {
+		return fmt.Errorf("expected clients with correlation id 51, got %v", values)
+	}
+	// the client id follows the remote address, both are strings
+	local := conn.LocalAddr().String()
+	expected := binary.BigEndian.AppendUint16(nil, uint16(len(local)))
+	expected = append(expected, local...)
+	expected = binary.BigEndian.AppendUint16(expected, uint16(len("conformance")))
+	expected = append(expected, "conformance"...)
+	for _, c := range values["Clients"].([][]byte) {
+		if bytes.HasPrefix(c, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("connection %s with client id conformance isn't listed in %v", local, values["Clients"])
+}
+
+func partitionOffsets(conn net.Conn, spec *protocol.Spec, correlationId uint64, partition string) (map[string]any, error) {
+	partitionOffsets, err := spec.Request("PartitionOffsets")
+	if err != nil {
+		return nil, err
+	}
+	request, err := partitionOffsets.Encode(map[string]any{
+		"CorrelationId": correlationId,
+		"Partition":     partition,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return nil, fmt.Errorf("error writing partition offsets request: %v", err)
+	}
+	response, err := spec.Response("PartitionOffsets")
+	if err != nil {
+		return nil, err
+	}
+	values, err := readResponse(conn, response)
+	if err != nil {
+		return nil, err
+	}
+	if values["CorrelationId"] != correlationId {
+		return nil, fmt.Errorf("expected partition offsets with correlation id %d, got %v", correlationId, values)
+	}
+	return values, nil
+}
+
+func setFrozen(conn net.Conn, spec *protocol.Spec, correlationId uint64, partition string, frozen uint8) error {
+	setPartitionFrozen, err := spec.Request("SetPartitionFrozen")
+	if err != nil {
+		return err
+	}
+	request, err := setPartitionFrozen.Encode(map[string]any{
+		"CorrelationId": correlationId,
+		"Partition":     partition,
+		"Frozen":        frozen,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing set partition frozen request: %v", err)
+	}
+	return expectOk(conn, spec, correlationId)
+}
+
+func sendProduce(conn net.Conn, spec *protocol.Spec, correlationId uint64, partition string, batchId uint64) error {
+	produce, err := spec.Request("Produce")
+	if err != nil {
+		return err
+	}
+	request, err := produce.Encode(map[string]any{
+		"CorrelationId": correlationId,
+		"Partition":     partition,
+		"BatchId":       batchId,
+		"Messages":      [][]byte{[]byte("conformance"), {}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("error writing produce request: %v", err)
+	}
+	return nil
+}
+
+func expectAck(conn net.Conn, spec *protocol.Spec, correlationId uint64, partition string, batchId uint64) error {
+	ack, err := spec.Response("ProduceAck")
+	if err != nil {
+		return err
+	}
+	values, err := readResponse(conn, ack)
+	if err != nil {
+		return err
+	}
+	if values["CorrelationId"] != correlationId || values["Partition"] != partition || values["BatchId"] != batchId {
+		return fmt.Errorf("expected ack of batch %d for partition %s with correlation id %d, got %v", batchId, partition, correlationId, values)
+	}
+	return nil
+}
+
+func expectOk(conn net.Conn, spec *protocol.Spec, correlationId uint64) error {
+	ok, err := spec.Response("Ok")
+	if err != nil {
+		return err
+	}
+	values, err := readResponse(conn, ok)
+	if err != nil {
+		return err
+	}
+	if values["CorrelationId"] != correlationId {
+		return fmt.Errorf("expected ok with correlation id %d, got %v", correlationId, values)
+	}
+	return nil
+}
+
+func expectError(conn net.Conn, spec *protocol.Spec, correlationId uint64) error {
+	errorResponse, err := spec.Response("Error")
+	if err != nil {
+		return err
+	}
+	values, err := readResponse(conn, errorResponse)
+	if err != nil {
+		return err
+	}
+	if values["CorrelationId"] != correlationId {
+		return fmt.Errorf("expected error with correlation id %d, got %v", correlationId, values)
+	}
+	return nil
+}
+
+func readResponse(conn net.Conn, expected *protocol.Message) (map[string]any, error) {
+	response, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) == 0 || response[0] != expected.Type {
+		return nil, fmt.Errorf("expected %s response, got %v", expected.Name, response)
+	}
+	return expected.Decode(response)
+}
+
+// readFrame returns the next response without its length
+func readFrame(conn net.Conn) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(responseTimeout))
+	lengthBytes := make([]byte, 4)
+	_, err := io.ReadFull(conn, lengthBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response length: %v", err)
+	}
+	response := make([]byte, binary.BigEndian.Uint32(lengthBytes))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response: %v", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,27 @@
+package conformance
+
+import (
+	"testing"
+
+	"github.com/lthiede/cartero/inproc"
+)
+
+func TestInprocBroker(t *testing.T) {
+	broker, err := inproc.NewBroker(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("error starting broker: %v", err)
+	}
+	defer broker.Close()
+	results, err := RunDial(broker.Dial, "partition0")
+	if err != nil {
+		t.Fatalf("error running checks: %v", err)
+	}
+	if len(results) != len(checks) {
+		t.Fatalf("expected %d results, got %d", len(checks), len(results))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("%s: %v", r.Name, r.Err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package connection
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/lthiede/cartero/messages"
+)
+
+// Clients keeps track of the open connections of a broker
+type Clients struct {
+	connections map[*Connection]struct{}
+	lock        sync.Mutex
+}
+
+func NewClients() *Clients {
+	return &Clients{
+		connections: map[*Connection]struct{}{},
+	}
+}
+
+// List returns the clients ordered by when they connected
+func (c *Clients) List() []messages.ClientInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clients := make([]messages.ClientInfo, 0, len(c.connections))
+	for conn := range c.connections {
+		clients = append(clients, conn.ClientInfo())
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Connected.Before(clients[j].Connected) })
+	return clients
+}
+
+func (c *Clients) add(conn *Connection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connections[conn] = struct{}{}
+}
+
+func (c *Clients) remove(conn *Connection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.connections, conn)
+}
@@ -2,9 +2,16 @@ package connection
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/lthiede/cartero/audit"
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/memory"
 	"github.com/lthiede/cartero/messages"
 	"github.com/lthiede/cartero/partition"
 	"go.uber.org/zap"
@@ -22,53 +29,190 @@ This seems limiting and unnecessary.
 For now I choose only to handle messages from the same client to the same partition
 in strict order, but I should discuss this with tobias
 
+Each connection queues produce requests per partition, so a slow partition
+doesn't block requests to other partitions. Responses are sent as soon as they
+are ready and can arrive out of order, clients match them to requests by
+correlation id
+
 Which errors are recoverable and which require the connection to be closed
 */
 
 /*
 Structure of Requests
-Request Length + Request Type + Payload
+Request Length + Request Type + Correlation Id + Payload
+
+The correlation id is picked by the client and returned in every response
+to the request. The broker includes it in all log lines for the request.
 
 Payload for Produce:
 Partition + BatchId + (Message Length + Message) * n
+
+Payload for Set Partition Frozen:
+Partition + Frozen (1 byte, 0 or 1)
+
+Payload for Partition Offsets:
+Partition
+
+Payload for Sample Records:
+Partition + Count (uint32) + Max Payload Bytes (uint32, 0 for complete payloads)
+
+Payload for Client Metadata:
+Client Id + Library Version + Host
+
+Payload for List Clients:
+empty
+
+Payload for Handoff Partition:
+Partition
+
+Payload for Set Compression:
+Codec, only gzip is supported
+
+After a successful Set Compression the broker may compress large responses.
+Compressed responses have the highest bit of the response type set and the
+payload after the correlation id is compressed
 */
 
 /*
 Structure of Responses
-Response Length + Response Type + Payload
+Response Length + Response Type + Correlation Id + Payload
 
 Payload for Produce Ack:
-Partition + BatchId
+Partition + BatchId + Broker Queueing Nanoseconds + Append Nanoseconds +
+Throttle Nanoseconds
+Producers should wait the throttle time before sending more batches
+
+Payload for Error:
+Error Message
+
+Payload for Ok:
+empty
+
+Payload for Partition Offsets:
+Log Start Offset + High Watermark + Last Stable Offset
+
+Payload for Sampled Records:
+First Offset + (Record Length + Message Size (uint32) + Possibly Truncated Message) * n
+
+Payload for Clients:
+(Client Length + Remote Address + Client Id + Library Version + Host + Connected Unix Nanoseconds) * n
 */
 
 type Connection struct {
 	conn        net.Conn
-	partitions  map[string]partition.Partition
+	partitions  map[string]*partition.Partition
+	audit       *audit.Log
+	memory      *memory.Monitor
 	produceAcks chan messages.ProduceAck
-	quit        chan int
-	logger      *zap.Logger
+	errors      chan messages.ErrorResponse
+	oks         chan uint64
+	offsets     chan partitionOffsetsResponse
+	samples     chan sampledRecordsResponse
+	clientLists chan clientsResponse
+	clients     *Clients
+	// reported by the client, see ClientInfo
+	info     messages.ClientInfo
+	infoLock sync.Mutex
+	clock    clock.Clock
+	// set by the request goroutine, read by the response goroutine
+	compressResponses atomic.Bool
+	// produce requests waiting for their partition, only used by the
+	// goroutine handling requests
+	produceQueues map[string]chan messages.ProduceRequest
+	// produce requests of the connection that weren't responded to yet
+	pending   atomic.Int64
+	quit      chan int
+	closeOnce sync.Once
+	logger    *zap.Logger
 }
 
 const (
 	RequestTypeProduce byte = iota
 	RequestTypeConsume
 	RequestTypeCreatePartition
+	RequestTypeSetPartitionFrozen
+	RequestTypePartitionOffsets
+	RequestTypeSampleRecords
+	RequestTypeClientMetadata
+	RequestTypeListClients
+	RequestTypeHandoffPartition
+	RequestTypeSetCompression
 )
 const (
 	ResponseTypeAckProduce byte = iota
+	ResponseTypeError
+	ResponseTypeOk
+	ResponseTypePartitionOffsets
+	ResponseTypeSampledRecords
+	ResponseTypeClients
 )
 
-func New(conn net.Conn, partitions map[string]partition.Partition, logger *zap.Logger) *Connection {
+type partitionOffsetsResponse struct {
+	correlationId uint64
+	offsets       messages.PartitionOffsets
+}
+
+type sampledRecordsResponse struct {
+	correlationId uint64
+	records       []messages.SampledRecord
+}
+
+type clientsResponse struct {
+	correlationId uint64
+	clients       []messages.ClientInfo
+}
+
+const requestHeaderLen = 1 + 8
+
+// produce requests per partition and connection that can wait for the
+// partition before reading more requests blocks
+const produceQueueSize = 64
+
+// larger batches are rejected while the broker is close to its memory limit
+const maxBatchBytesUnderPressure = 64 << 10
+
+// acks ask producers to wait up to maxThrottle before sending more. The hint
+// grows once more than produceQueueSize/2 produce requests of the connection
+// are pending and is the maximum while the broker is close to its memory limit
+const maxThrottle = 100 * time.Millisecond
+
+func New(conn net.Conn, partitions map[string]*partition.Partition, auditLog *audit.Log, memoryMonitor *memory.Monitor, clients *Clients, clk clock.Clock, logger *zap.Logger) *Connection {
 	c := &Connection{
 		conn,
 		partitions,
+		auditLog,
+		memoryMonitor,
 		make(chan messages.ProduceAck),
+		make(chan messages.ErrorResponse),
+		make(chan uint64),
+		make(chan partitionOffsetsResponse),
+		make(chan sampledRecordsResponse),
+		make(chan clientsResponse),
+		clients,
+		messages.ClientInfo{
+			Remote:    conn.RemoteAddr().String(),
+			Connected: clk.Now(),
+		},
+		sync.Mutex{},
+		clk,
+		atomic.Bool{},
+		map[string]chan messages.ProduceRequest{},
+		atomic.Int64{},
 		make(chan int),
+		sync.Once{},
 		logger,
 	}
+	clients.add(c)
 	return c
 }
 
+// ClientInfo returns what is known about the client on the other end
+func (c *Connection) ClientInfo() messages.ClientInfo {
+	c.infoLock.Lock()
+	defer c.infoLock.Unlock()
+	return c.info
+}
+
 func (c *Connection) HandleRequests() {
 	go c.HandleResponses()
 	c.logger.Info("Start handling requests")
@@ -84,88 +228,385 @@ func (c *Connection) HandleRequests() {
 				c.Close()
 				continue
 			}
-			err = c.handleRequest(request)
+			if len(request) < requestHeaderLen {
+				c.logger.Error("Request too short to contain header", zap.Int("requestLength", len(request)))
+				c.Close()
+				continue
+			}
+			correlationId, _, err := messages.NextUInt64(request[1:])
 			if err != nil {
-				c.logger.Error("Error handling request", zap.Error(err))
+				c.logger.Error("Error parsing correlation id", zap.Error(err))
 				c.Close()
+				continue
+			}
+			logger := c.logger.With(zap.Uint64("correlationId", correlationId))
+			// the request is framed, so the next request can still be
+			// read if handling this one fails
+			err = c.handleRequest(request[0], correlationId, request[requestHeaderLen:], c.clock.Now(), logger)
+			if err != nil {
+				logger.Error("Error handling request", zap.Error(err))
+				c.respondError(correlationId, err)
 			}
 		}
 	}
 }
 
-func (c *Connection) handleRequest(request []byte) error {
-	switch request[0] {
+func (c *Connection) handleRequest(requestType byte, correlationId uint64, request []byte, received time.Time, logger *zap.Logger) error {
+	switch requestType {
 	case RequestTypeProduce:
-		c.logger.Info("Handling produce request")
-		err := c.produce(request[1:])
+		logger.Info("Handling produce request")
+		err := c.produce(correlationId, request, received, logger)
 		if err != nil {
 			return fmt.Errorf("error handling produce request %v", err)
 		}
 	case RequestTypeConsume:
-		c.logger.Info("Handling consume request")
-		err := c.consume(request[1:])
+		logger.Info("Handling consume request")
+		err := c.consume(request)
 		if err != nil {
 			return fmt.Errorf("error handling consume request %v", err)
 		}
 	case RequestTypeCreatePartition:
-		c.logger.Info("Handling topic creation request")
-		err := c.topic(request[1:])
+		logger.Info("Handling topic creation request")
+		err := c.topic(request)
 		if err != nil {
 			return fmt.Errorf("error handling partition request %v", err)
 		}
+	case RequestTypeSetPartitionFrozen:
+		logger.Info("Handling set partition frozen request")
+		err := c.setPartitionFrozen(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling set partition frozen request: %v", err)
+		}
+	case RequestTypePartitionOffsets:
+		logger.Info("Handling partition offsets request")
+		err := c.partitionOffsets(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling partition offsets request: %v", err)
+		}
+	case RequestTypeSampleRecords:
+		logger.Info("Handling sample records request")
+		err := c.sampleRecords(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling sample records request: %v", err)
+		}
+	case RequestTypeClientMetadata:
+		logger.Info("Handling client metadata request")
+		err := c.clientMetadata(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling client metadata request: %v", err)
+		}
+	case RequestTypeHandoffPartition:
+		logger.Info("Handling handoff partition request")
+		err := c.handoffPartition(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling handoff partition request: %v", err)
+		}
+	case RequestTypeSetCompression:
+		logger.Info("Handling set compression request")
+		err := c.setCompression(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling set compression request: %v", err)
+		}
+	case RequestTypeListClients:
+		logger.Info("Handling list clients request")
+		err := c.listClients(correlationId, request, logger)
+		if err != nil {
+			return fmt.Errorf("error handling list clients request: %v", err)
+		}
 	default:
-		return fmt.Errorf("received unrecognized request %v", request[0])
+		return fmt.Errorf("received unrecognized request %v", requestType)
 	}
 	return nil
 }
 
+func (c *Connection) respondOk(correlationId uint64) {
+	select {
+	case c.oks <- correlationId:
+	case <-c.quit:
+	}
+}
+
+func (c *Connection) respondError(correlationId uint64, err error) {
+	select {
+	case c.errors <- messages.ErrorResponse{
+		CorrelationId: correlationId,
+		Message:       err.Error(),
+	}:
+	case <-c.quit:
+	}
+}
+
 func (c *Connection) Close() error {
-	c.logger.Debug("Closing connection")
-	close(c.quit)
-	c.conn.Close()
+	// requests and responses are handled concurrently and both close the
+	// connection on errors
+	c.closeOnce.Do(func() {
+		c.logger.Debug("Closing connection")
+		c.clients.remove(c)
+		close(c.quit)
+		c.conn.Close()
+	})
 	return nil
 }
 
-func (c *Connection) produce(request []byte) error {
-	partitionName, bytesUsed, err := messages.NextString(request, c.logger)
+func (c *Connection) produce(correlationId uint64, request []byte, received time.Time, logger *zap.Logger) error {
+	partitionName, bytesUsed, err := messages.NextString(request, logger)
 	if err != nil {
 		return fmt.Errorf("error parsing the partition name: %v", err)
 	}
-	c.logger.Debug("Parsed", zap.String("partitionName", partitionName))
+	logger.Debug("Parsed", zap.String("partitionName", partitionName))
 	bytesUsedTotal := bytesUsed
 	batchId, bytesUsed, err := messages.NextUInt64(request[bytesUsedTotal:])
 	if err != nil {
 		return fmt.Errorf("error parsing the batch id: %v", err)
 	}
-	c.logger.Debug("Parsed", zap.Uint64("batchId", batchId))
+	logger.Debug("Parsed", zap.Uint64("batchId", batchId))
 	bytesUsedTotal += bytesUsed
-	p := c.partitions[partitionName]
-	p.Input <- messages.ProduceRequest{
-		ProduceAck: c.produceAcks,
-		BatchId:    batchId,
-		Payload:    request[bytesUsedTotal:],
+	p, ok := c.partitions[partitionName]
+	if !ok {
+		return fmt.Errorf("partition %s doesn't exist", partitionName)
+	}
+	if c.memory.UnderPressure() && len(request)-bytesUsedTotal > maxBatchBytesUnderPressure {
+		return fmt.Errorf("broker is close to its memory limit, rejecting batch of %d bytes, the limit is %d bytes", len(request)-bytesUsedTotal, maxBatchBytesUnderPressure)
+	}
+	queue, ok := c.produceQueues[partitionName]
+	if !ok {
+		queue = make(chan messages.ProduceRequest, produceQueueSize)
+		c.produceQueues[partitionName] = queue
+		go c.forwardProduce(p, queue)
+	}
+	c.pending.Add(1)
+	select {
+	case queue <- messages.ProduceRequest{
+		ProduceAck:     c.produceAcks,
+		ConnectionQuit: c.quit,
+		CorrelationId:  correlationId,
+		BatchId:        batchId,
+		Payload:        request[bytesUsedTotal:],
+		Received:       received,
+	}:
+	case <-c.quit:
 	}
 	return nil
 }
 
-func (c *Connection) consume(request []byte) error {
-	// stub
+// forwardProduce hands the queued requests to the partition in order
+func (c *Connection) forwardProduce(p *partition.Partition, queue <-chan messages.ProduceRequest) {
+	for {
+		select {
+		case pr := <-queue:
+			select {
+			case p.Input <- pr:
+			case <-c.quit:
+				return
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+func (c *Connection) setPartitionFrozen(correlationId uint64, request []byte, logger *zap.Logger) error {
+	partitionName, bytesUsed, err := messages.NextString(request, logger)
+	if err != nil {
+		return fmt.Errorf("error parsing the partition name: %v", err)
+	}
+	if len(request) != bytesUsed+1 || request[bytesUsed] > 1 {
+		return fmt.Errorf("expected a single byte 0 or 1 after the partition name")
+	}
+	frozen := request[bytesUsed] == 1
+	p, ok := c.partitions[partitionName]
+	if !ok {
+		return fmt.Errorf("partition %s doesn't exist", partitionName)
+	}
+	p.SetFrozen(frozen)
+	operation := audit.OperationUnfreezePartition
+	if frozen {
+		operation = audit.OperationFreezePartition
+	}
+	c.audit.Record(audit.Event{
+		Operation: operation,
+		Partition: partitionName,
+		Remote:    c.conn.RemoteAddr().String(),
+		Success:   true,
+	})
+	c.respondOk(correlationId)
 	return nil
 }
 
-func (c *Connection) topic(request []byte) error {
-	// stub
+func (c *Connection) handoffPartition(correlationId uint64, request []byte, logger *zap.Logger) error {
+	partitionName, _, err := messages.NextString(request, logger)
+	if err != nil {
+		return fmt.Errorf("error parsing the partition name: %v", err)
+	}
+	p, ok := c.partitions[partitionName]
+	if !ok {
+		return fmt.Errorf("partition %s doesn't exist", partitionName)
+	}
+	err = p.Handoff()
+	event := audit.Event{
+		Operation: audit.OperationHandoffPartition,
+		Partition: partitionName,
+		Remote:    c.conn.RemoteAddr().String(),
+		Success:   err == nil,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	c.audit.Record(event)
+	if err != nil {
+		return fmt.Errorf("error handing off partition %s: %v", partitionName, err)
+	}
+	c.respondOk(correlationId)
+	return nil
+}
+
+func (c *Connection) partitionOffsets(correlationId uint64, request []byte, logger *zap.Logger) error {
+	partitionName, _, err := messages.NextString(request, logger)
+	if err != nil {
+		return fmt.Errorf("error parsing the partition name: %v", err)
+	}
+	p, ok := c.partitions[partitionName]
+	if !ok {
+		return fmt.Errorf("partition %s doesn't exist", partitionName)
+	}
+	select {
+	case c.offsets <- partitionOffsetsResponse{correlationId, p.Offsets()}:
+	case <-c.quit:
+	}
+	return nil
+}
+
+func (c *Connection) sampleRecords(correlationId uint64, request []byte, logger *zap.Logger) error {
+	partitionName, bytesUsed, err := messages.NextString(request, logger)
+	if err != nil {
+		return fmt.Errorf("error parsing the partition name: %v", err)
+	}
+	if len(request) != bytesUsed+4+4 {
+		return fmt.Errorf("expected count and max payload bytes after the partition name")
+	}
+	count := binary.BigEndian.Uint32(request[bytesUsed:])
+	maxBytes := binary.BigEndian.Uint32(request[bytesUsed+4:])
+	p, ok := c.partitions[partitionName]
+	if !ok {
+		return fmt.Errorf("partition %s doesn't exist", partitionName)
+	}
+	records, err := p.Sample(int(count), int(maxBytes))
+	if err != nil {
+		return fmt.Errorf("error sampling partition %s: %v", partitionName, err)
+	}
+	select {
+	case c.samples <- sampledRecordsResponse{correlationId, records}:
+	case <-c.quit:
+	}
+	return nil
+}
+
+func (c *Connection) clientMetadata(correlationId uint64, request []byte, logger *zap.Logger) error {
+	fields := make([]string, 3)
+	bytesUsedTotal := 0
+	for i := range fields {
+		field, bytesUsed, err := messages.NextString(request[bytesUsedTotal:], logger)
+		if err != nil {
+			return fmt.Errorf("error parsing field %d of the client metadata: %v", i, err)
+		}
+		fields[i] = field
+		bytesUsedTotal += bytesUsed
+	}
+	c.infoLock.Lock()
+	c.info.ClientId = fields[0]
+	c.info.LibraryVersion = fields[1]
+	c.info.Host = fields[2]
+	c.infoLock.Unlock()
+	logger.Info("Client reported metadata", zap.String("clientId", fields[0]), zap.String("libraryVersion", fields[1]), zap.String("host", fields[2]))
+	c.respondOk(correlationId)
+	return nil
+}
+
+func (c *Connection) setCompression(correlationId uint64, request []byte, logger *zap.Logger) error {
+	codec, _, err := messages.NextString(request, logger)
+	if err != nil {
+		return fmt.Errorf("error parsing the codec: %v", err)
+	}
+	if codec != messages.CodecGzip {
+		return fmt.Errorf("unsupported codec %s", codec)
+	}
+	c.compressResponses.Store(true)
+	logger.Info("Compressing large responses", zap.String("codec", codec))
+	c.respondOk(correlationId)
+	return nil
+}
+
+func (c *Connection) listClients(correlationId uint64, request []byte, logger *zap.Logger) error {
+	if len(request) != 0 {
+		return fmt.Errorf("expected no payload, got %d bytes", len(request))
+	}
+	clients := c.clients.List()
+	logger.Debug("Listing clients", zap.Int("clients", len(clients)))
+	select {
+	case c.clientLists <- clientsResponse{correlationId, clients}:
+	case <-c.quit:
+	}
 	return nil
 }
 
+func (c *Connection) consume(request []byte) error {
+	return errors.New("not implemented")
+}
+
+func (c *Connection) topic(request []byte) error {
+	return errors.New("not implemented")
+}
+
 func (c *Connection) HandleResponses() {
 	c.logger.Info("Start handling responses")
 	for {
 		select {
 		case produceAck := <-c.produceAcks:
+			c.pending.Add(-1)
+			if produceAck.Err != nil {
+				err := c.respondWithError(messages.ErrorResponse{
+					CorrelationId: produceAck.CorrelationId,
+					Message:       produceAck.Err.Error(),
+				})
+				if err != nil {
+					c.logger.Error("Failed to send error response", zap.Uint64("correlationId", produceAck.CorrelationId), zap.Error(err))
+					c.Close()
+				}
+				continue
+			}
 			err := c.ackProduce(produceAck)
 			if err != nil {
-				c.logger.Error("Failed to acknowledge produce", zap.Error(err))
+				c.logger.Error("Failed to acknowledge produce", zap.Uint64("correlationId", produceAck.CorrelationId), zap.Error(err))
+				c.Close()
+			}
+		case correlationId := <-c.oks:
+			err := c.respondWithOk(correlationId)
+			if err != nil {
+				c.logger.Error("Failed to send ok response", zap.Uint64("correlationId", correlationId), zap.Error(err))
+				c.Close()
+			}
+		case offsets := <-c.offsets:
+			err := c.respondWithOffsets(offsets)
+			if err != nil {
+				c.logger.Error("Failed to send partition offsets", zap.Uint64("correlationId", offsets.correlationId), zap.Error(err))
+				c.Close()
+			}
+		case samples := <-c.samples:
+			err := c.respondWithSamples(samples)
+			if err != nil {
+				c.logger.Error("Failed to send sampled records", zap.Uint64("correlationId", samples.correlationId), zap.Error(err))
+				c.Close()
+			}
+		case clients := <-c.clientLists:
+			err := c.respondWithClients(clients)
+			if err != nil {
+				c.logger.Error("Failed to send clients", zap.Uint64("correlationId", clients.correlationId), zap.Error(err))
+				c.Close()
+			}
+		case errorResponse := <-c.errors:
+			err := c.respondWithError(errorResponse)
+			if err != nil {
+				c.logger.Error("Failed to send error response", zap.Uint64("correlationId", errorResponse.CorrelationId), zap.Error(err))
 				c.Close()
 			}
 		case <-c.quit:
@@ -175,23 +616,170 @@ func (c *Connection) HandleResponses() {
 	}
 }
 
+// write sends a complete response frame, compressed if the client asked for
+// it and the frame is large enough
+func (c *Connection) write(response []byte) (int, error) {
+	if c.compressResponses.Load() && len(response) >= messages.MinCompressedFrameLen {
+		compressed, err := messages.CompressFrame(response)
+		if err != nil {
+			return 0, err
+		}
+		response = compressed
+	}
+	return c.conn.Write(response)
+}
+
+// throttle returns how long the producer should hold back further batches
+func (c *Connection) throttle() time.Duration {
+	if c.memory.UnderPressure() {
+		return maxThrottle
+	}
+	half := int64(produceQueueSize / 2)
+	pending := c.pending.Load()
+	if pending <= half {
+		return 0
+	}
+	throttle := maxThrottle * time.Duration(pending-half) / time.Duration(half)
+	if throttle > maxThrottle {
+		return maxThrottle
+	}
+	return throttle
+}
+
 func (c *Connection) ackProduce(ack messages.ProduceAck) error {
 	// not including bytes encoding response length
-	responseLen := 1 + 2 + len(ack.PartitionName) + 8
+	responseLen := 1 + 8 + 2 + len(ack.PartitionName) + 8 + 8 + 8 + 8
 	responseLengthEncodingLen := 4
 	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
 	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
 	response = append(response, ResponseTypeAckProduce)
+	response = binary.BigEndian.AppendUint64(response, ack.CorrelationId)
 	response = binary.BigEndian.AppendUint16(response, uint16(len(ack.PartitionName)))
 	response = append(response, []byte(ack.PartitionName)...)
 	response = binary.BigEndian.AppendUint64(response, uint64(ack.BatchId))
-	n, err := c.conn.Write(response)
+	response = binary.BigEndian.AppendUint64(response, uint64(ack.Latency.BrokerQueue))
+	response = binary.BigEndian.AppendUint64(response, uint64(ack.Latency.Append))
+	response = binary.BigEndian.AppendUint64(response, uint64(c.throttle()))
+	n, err := c.write(response)
 	if err != nil {
 		if n != 5 {
 			return fmt.Errorf("failed to write complete acknowledge produce response: %v", err)
 		}
-		c.logger.Error("Error writing acknowledge produce response", zap.Error(err))
+		c.logger.Error("Error writing acknowledge produce response", zap.Uint64("correlationId", ack.CorrelationId), zap.Error(err))
+	}
+	c.logger.Info("Acknowledged batch", zap.Uint64("correlationId", ack.CorrelationId), zap.String("partition", ack.PartitionName), zap.Uint64("batchId", ack.BatchId))
+	return nil
+}
+
+func (c *Connection) respondWithError(errorResponse messages.ErrorResponse) error {
+	// not including bytes encoding response length
+	responseLen := 1 + 8 + 2 + len(errorResponse.Message)
+	responseLengthEncodingLen := 4
+	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
+	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
+	response = append(response, ResponseTypeError)
+	response = binary.BigEndian.AppendUint64(response, errorResponse.CorrelationId)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(errorResponse.Message)))
+	response = append(response, []byte(errorResponse.Message)...)
+	n, err := c.write(response)
+	if err != nil {
+		return fmt.Errorf("failed to write error response, wrote %d of %d bytes: %v", n, len(response), err)
+	}
+	c.logger.Info("Sent error response", zap.Uint64("correlationId", errorResponse.CorrelationId))
+	return nil
+}
+
+func (c *Connection) respondWithOk(correlationId uint64) error {
+	// not including bytes encoding response length
+	responseLen := 1 + 8
+	responseLengthEncodingLen := 4
+	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
+	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
+	response = append(response, ResponseTypeOk)
+	response = binary.BigEndian.AppendUint64(response, correlationId)
+	n, err := c.write(response)
+	if err != nil {
+		return fmt.Errorf("failed to write ok response, wrote %d of %d bytes: %v", n, len(response), err)
+	}
+	c.logger.Info("Sent ok response", zap.Uint64("correlationId", correlationId))
+	return nil
+}
+
+func (c *Connection) respondWithOffsets(offsets partitionOffsetsResponse) error {
+	// not including bytes encoding response length
+	responseLen := 1 + 8 + 8 + 8 + 8
+	responseLengthEncodingLen := 4
+	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
+	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
+	response = append(response, ResponseTypePartitionOffsets)
+	response = binary.BigEndian.AppendUint64(response, offsets.correlationId)
+	response = binary.BigEndian.AppendUint64(response, offsets.offsets.LogStart)
+	response = binary.BigEndian.AppendUint64(response, offsets.offsets.HighWatermark)
+	response = binary.BigEndian.AppendUint64(response, offsets.offsets.LastStable)
+	n, err := c.write(response)
+	if err != nil {
+		return fmt.Errorf("failed to write partition offsets response, wrote %d of %d bytes: %v", n, len(response), err)
+	}
+	c.logger.Info("Sent partition offsets", zap.Uint64("correlationId", offsets.correlationId))
+	return nil
+}
+
+func (c *Connection) respondWithSamples(samples sampledRecordsResponse) error {
+	// not including bytes encoding response length
+	responseLen := 1 + 8 + 8
+	for _, r := range samples.records {
+		responseLen += 4 + 4 + len(r.Payload)
+	}
+	var firstOffset uint64
+	if len(samples.records) > 0 {
+		firstOffset = samples.records[0].Offset
+	}
+	responseLengthEncodingLen := 4
+	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
+	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
+	response = append(response, ResponseTypeSampledRecords)
+	response = binary.BigEndian.AppendUint64(response, samples.correlationId)
+	response = binary.BigEndian.AppendUint64(response, firstOffset)
+	for _, r := range samples.records {
+		response = binary.BigEndian.AppendUint32(response, uint32(4+len(r.Payload)))
+		response = binary.BigEndian.AppendUint32(response, r.Size)
+		response = append(response, r.Payload...)
+	}
+	n, err := c.write(response)
+	if err != nil {
+		return fmt.Errorf("failed to write sampled records response, wrote %d of %d bytes: %v", n, len(response), err)
+	}
+	c.logger.Info("Sent sampled records", zap.Uint64("correlationId", samples.correlationId), zap.Int("records", len(samples.records)))
+	return nil
+}
+
+func (c *Connection) respondWithClients(clients clientsResponse) error {
+	// not including bytes encoding response length
+	responseLen := 1 + 8
+	for _, client := range clients.clients {
+		responseLen += 4 + clientInfoLen(client)
+	}
+	responseLengthEncodingLen := 4
+	response := make([]byte, 0, responseLen+responseLengthEncodingLen)
+	response = binary.BigEndian.AppendUint32(response, uint32(responseLen))
+	response = append(response, ResponseTypeClients)
+	response = binary.BigEndian.AppendUint64(response, clients.correlationId)
+	for _, client := range clients.clients {
+		response = binary.BigEndian.AppendUint32(response, uint32(clientInfoLen(client)))
+		for _, field := range []string{client.Remote, client.ClientId, client.LibraryVersion, client.Host} {
+			response = binary.BigEndian.AppendUint16(response, uint16(len(field)))
+			response = append(response, []byte(field)...)
+		}
+		response = binary.BigEndian.AppendUint64(response, uint64(client.Connected.UnixNano()))
+	}
+	n, err := c.write(response)
+	if err != nil {
+		return fmt.Errorf("failed to write clients response, wrote %d of %d bytes: %v", n, len(response), err)
 	}
-	c.logger.Info("Acknowledged batch", zap.String("partition", ack.PartitionName), zap.Uint64("batchId", ack.BatchId))
+	c.logger.Info("Sent clients", zap.Uint64("correlationId", clients.correlationId), zap.Int("clients", len(clients.clients)))
 	return nil
 }
+
+func clientInfoLen(client messages.ClientInfo) int {
+	return 2 + len(client.Remote) + 2 + len(client.ClientId) + 2 + len(client.LibraryVersion) + 2 + len(client.Host) + 8
+}
@@ -0,0 +1,130 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/messages"
+	"go.uber.org/zap"
+)
+
+/*
+Structure of encrypted messages
+Key Id + Wrapped Data Key Length + Wrapped Data Key + Nonce + Ciphertext
+
+The key id and the wrapped data key allow consumers to ask the key provider
+for the plaintext data key. The broker only ever sees ciphertext.
+*/
+
+// KeyProvider abstracts the key management service holding the master keys
+type KeyProvider interface {
+	// GenerateDataKey returns a fresh data key in plaintext and wrapped by
+	// the master key identified by keyId
+	GenerateDataKey() (keyId string, plaintext []byte, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key wrapped by the master key keyId
+	DecryptDataKey(keyId string, wrapped []byte) ([]byte, error)
+}
+
+// Encryptor encrypts batches as a producer interceptor and decrypts
+// messages for consumers
+type Encryptor struct {
+	keys   KeyProvider
+	logger *zap.Logger
+}
+
+func New(keys KeyProvider, logger logging.Logger) *Encryptor {
+	return &Encryptor{
+		keys,
+		logging.Zap(logger),
+	}
+}
+
+// BeforeSend encrypts all messages of a batch with one new data key
+func (e *Encryptor) BeforeSend(partition string, batchId uint64, batch [][]byte) ([][]byte, error) {
+	keyId, key, wrapped, err := e.keys.GenerateDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("error generating data key: %v", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e.logger.Debug("Encrypting batch", zap.String("partition", partition), zap.Uint64("batchId", batchId), zap.String("keyId", keyId))
+	encrypted := make([][]byte, 0, len(batch))
+	for _, m := range batch {
+		headerLen := 2 + len(keyId) + 2 + len(wrapped) + aead.NonceSize()
+		message := make([]byte, 0, headerLen+len(m)+aead.Overhead())
+		message = binary.BigEndian.AppendUint16(message, uint16(len(keyId)))
+		message = append(message, []byte(keyId)...)
+		message = binary.BigEndian.AppendUint16(message, uint16(len(wrapped)))
+		message = append(message, wrapped...)
+		nonce := make([]byte, aead.NonceSize())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return nil, fmt.Errorf("error generating nonce: %v", err)
+		}
+		message = append(message, nonce...)
+		message = aead.Seal(message, nonce, m, nil)
+		encrypted = append(encrypted, message)
+	}
+	return encrypted, nil
+}
+
+func (e *Encryptor) AfterAck(ack messages.ProduceAck) {}
+
+// Decrypt returns the plaintext of a message encrypted by BeforeSend
+func (e *Encryptor) Decrypt(message []byte) ([]byte, error) {
+	keyId, bytesUsed, err := nextBytes(message)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key id: %v", err)
+	}
+	wrapped, n, err := nextBytes(message[bytesUsed:])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing wrapped data key: %v", err)
+	}
+	bytesUsed += n
+	key, err := e.keys.DecryptDataKey(string(keyId), wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key with key %s: %v", keyId, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(message[bytesUsed:]) < aead.NonceSize() {
+		return nil, fmt.Errorf("message too short to contain nonce")
+	}
+	nonce := message[bytesUsed : bytesUsed+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, message[bytesUsed+aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting message: %v", err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating gcm: %v", err)
+	}
+	return aead, nil
+}
+
+func nextBytes(b []byte) ([]byte, int, error) {
+	if len(b) < 2 {
+		return nil, 0, fmt.Errorf("couldn't read 2 bytes encoding length, only %d bytes left", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+length {
+		return nil, 0, fmt.Errorf("couldn't read %d bytes, only %d bytes left", length, len(b)-2)
+	}
+	return b[2 : 2+length], 2 + length, nil
+}
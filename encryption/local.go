@@ -0,0 +1,65 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// LocalKeyProvider wraps data keys with master keys held in memory. It's
+// meant for development, real deployments should implement KeyProvider on
+// top of their KMS
+type LocalKeyProvider struct {
+	currentKeyId string
+	masterKeys   map[string][]byte
+}
+
+// NewLocalKeyProvider creates new data keys with the master key
+// currentKeyId and can unwrap data keys of all given master keys. Master
+// keys need to be 16, 24 or 32 bytes long
+func NewLocalKeyProvider(currentKeyId string, masterKeys map[string][]byte) (*LocalKeyProvider, error) {
+	if _, ok := masterKeys[currentKeyId]; !ok {
+		return nil, fmt.Errorf("no master key with id %s", currentKeyId)
+	}
+	return &LocalKeyProvider{
+		currentKeyId,
+		masterKeys,
+	}, nil
+}
+
+func (l *LocalKeyProvider) GenerateDataKey() (string, []byte, []byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error generating data key: %v", err)
+	}
+	aead, err := newAEAD(l.masterKeys[l.currentKeyId])
+	if err != nil {
+		return "", nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error generating nonce: %v", err)
+	}
+	wrapped := aead.Seal(nonce, nonce, key, nil)
+	return l.currentKeyId, key, wrapped, nil
+}
+
+func (l *LocalKeyProvider) DecryptDataKey(keyId string, wrapped []byte) ([]byte, error) {
+	masterKey, ok := l.masterKeys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("no master key with id %s", keyId)
+	}
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped data key too short to contain nonce")
+	}
+	key, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,94 @@
+package inproc
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/server"
+)
+
+type addr struct{}
+
+func (addr) Network() string { return "inproc" }
+func (addr) String() string  { return "inproc" }
+
+// Listener is a net.Listener for connections created by Dial in the same
+// process. It doesn't touch the network at all
+type Listener struct {
+	conns     chan net.Conn
+	quit      chan int
+	closeOnce sync.Once
+}
+
+func NewListener() *Listener {
+	return &Listener{
+		conns: make(chan net.Conn),
+		quit:  make(chan int),
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.quit:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.quit)
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return addr{}
+}
+
+// Dial returns the client side of a new connection. The server side is
+// returned by Accept
+func (l *Listener) Dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.quit:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Broker is a complete broker serving in process connections, meant for
+// hermetic tests of applications using cartero
+type Broker struct {
+	server   *server.Server
+	listener *Listener
+}
+
+// NewBroker starts a broker storing its data in dataDir, usually a
+// temporary directory
+func NewBroker(dataDir string, logger logging.Logger, opts ...server.Option) (*Broker, error) {
+	s, err := server.New(dataDir, logger, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating server: %v", err)
+	}
+	l := NewListener()
+	go s.Serve(l)
+	return &Broker{
+		s,
+		l,
+	}, nil
+}
+
+func (b *Broker) Dial() (net.Conn, error) {
+	return b.listener.Dial()
+}
+
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
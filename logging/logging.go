@@ -0,0 +1,156 @@
+package logging
+
+import (
+	"fmt"
+	"sort"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is the logging interface of cartero's public constructors. It's
+// satisfied by *slog.Logger and easy to implement on top of other logging
+// libraries. Internally cartero logs with zap, see Zap and FromZap
+type Logger interface {
+	Debug(msg string, keysAndValues ...any)
+	Info(msg string, keysAndValues ...any)
+	Warn(msg string, keysAndValues ...any)
+	Error(msg string, keysAndValues ...any)
+}
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// LevelEnabler can be implemented by a Logger that discards some levels.
+// cartero then skips building log entries for them, which is expensive for
+// the debug logs on the produce path. *slog.Logger is recognized without it
+type LevelEnabler interface {
+	Enabled(level Level) bool
+}
+
+type zapLogger struct {
+	logger  *zap.Logger
+	sugared *zap.SugaredLogger
+}
+
+// FromZap adapts a zap logger. Passing the result to Zap returns the original
+// zap logger, so zap users don't pay for the indirection
+func FromZap(logger *zap.Logger) Logger {
+	return zapLogger{
+		logger,
+		logger.WithOptions(zap.AddCallerSkip(1)).Sugar(),
+	}
+}
+
+func (z zapLogger) Debug(msg string, keysAndValues ...any) {
+	z.sugared.Debugw(msg, keysAndValues...)
+}
+
+func (z zapLogger) Info(msg string, keysAndValues ...any) {
+	z.sugared.Infow(msg, keysAndValues...)
+}
+
+func (z zapLogger) Warn(msg string, keysAndValues ...any) {
+	z.sugared.Warnw(msg, keysAndValues...)
+}
+
+func (z zapLogger) Error(msg string, keysAndValues ...any) {
+	z.sugared.Errorw(msg, keysAndValues...)
+}
+
+// Zap returns a zap logger writing to logger. A nil logger discards all logs
+func Zap(logger Logger) *zap.Logger {
+	if logger == nil {
+		return zap.NewNop()
+	}
+	if z, ok := logger.(zapLogger); ok {
+		return z.logger
+	}
+	enabled := func(Level) bool { return true }
+	if e, ok := logger.(LevelEnabler); ok {
+		enabled = e.Enabled
+	} else if e := slogEnabled(logger); e != nil {
+		enabled = e
+	}
+	return zap.New(&core{logger: logger, enabled: enabled})
+}
+
+// core forwards zap entries to a Logger, levels are filtered by enabled
+type core struct {
+	logger  Logger
+	enabled func(Level) bool
+	fields  []zapcore.Field
+}
+
+func (c *core) Enabled(level zapcore.Level) bool {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return c.enabled(LevelDebug)
+	case level == zapcore.InfoLevel:
+		return c.enabled(LevelInfo)
+	case level == zapcore.WarnLevel:
+		return c.enabled(LevelWarn)
+	default:
+		return c.enabled(LevelError)
+	}
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	combined := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	combined = append(combined, c.fields...)
+	combined = append(combined, fields...)
+	return &core{
+		c.logger,
+		c.enabled,
+		combined,
+	}
+}
+
+func (c *core) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.Enabled(entry.Level) {
+		return checked
+	}
+	return checked.AddCore(entry, c)
+}
+
+func (c *core) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	encoder := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(encoder)
+	}
+	for _, f := range fields {
+		f.AddTo(encoder)
+	}
+	keys := make([]string, 0, len(encoder.Fields))
+	for k := range encoder.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	keysAndValues := make([]any, 0, 2*len(keys))
+	for _, k := range keys {
+		keysAndValues = append(keysAndValues, k, encoder.Fields[k])
+	}
+	switch {
+	case entry.Level == zapcore.DebugLevel:
+		c.logger.Debug(entry.Message, keysAndValues...)
+	case entry.Level == zapcore.InfoLevel:
+		c.logger.Info(entry.Message, keysAndValues...)
+	case entry.Level == zapcore.WarnLevel:
+		c.logger.Warn(entry.Message, keysAndValues...)
+	case entry.Level >= zapcore.ErrorLevel:
+		c.logger.Error(entry.Message, keysAndValues...)
+	default:
+		return fmt.Errorf("unknown log level %v", entry.Level)
+	}
+	return nil
+}
+
+func (c *core) Sync() error {
+	return nil
+}
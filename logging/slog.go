@@ -0,0 +1,29 @@
+//go:build go1.21
+
+package logging
+
+import (
+	"context"
+	"log/slog"
+)
+
+var slogLevels = map[Level]slog.Level{
+	LevelDebug: slog.LevelDebug,
+	LevelInfo:  slog.LevelInfo,
+	LevelWarn:  slog.LevelWarn,
+	LevelError: slog.LevelError,
+}
+
+// slogEnabled returns the level filter of slog loggers and handlers, nil
+// for other loggers
+func slogEnabled(logger Logger) func(Level) bool {
+	l, ok := logger.(interface {
+		Enabled(ctx context.Context, level slog.Level) bool
+	})
+	if !ok {
+		return nil
+	}
+	return func(level Level) bool {
+		return l.Enabled(context.Background(), slogLevels[level])
+	}
+}
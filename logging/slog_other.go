@@ -0,0 +1,7 @@
+//go:build !go1.21
+
+package logging
+
+func slogEnabled(logger Logger) func(Level) bool {
+	return nil
+}
@@ -1,16 +1,49 @@
 package main
 
 import (
+	"expvar"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/partition"
+	"github.com/lthiede/cartero/procstats"
 	"github.com/lthiede/cartero/server"
+	"github.com/lthiede/cartero/slo"
 	"go.uber.org/zap"
 )
 
 func main() {
+	debugAddress := flag.String("debug-address", "", "serve pprof on this address, e.g. localhost:6060")
+	memoryLimit := flag.Int64("memory-limit", 0, "soft memory limit in bytes, 0 keeps GOMEMLIMIT. Large batches are rejected close to the limit")
+	gcPercent := flag.Int("gc-percent", 0, "garbage collection target percentage, 0 keeps GOGC and negative values disable the collector")
+	validate := flag.Bool("validate", false, "check the data directory and ports and exit instead of starting the broker")
+	maxMessageSizes := maxMessageSizeFlag{}
+	flag.Var(maxMessageSizes, "max-message-size", "reject batches with messages larger than this, as partition=bytes. Can be repeated")
+	objectives := sloFlag{}
+	flag.Var(objectives, "slo", "track a latency objective, as partition=latency:target, e.g. partition0=5ms:0.999. Can be repeated")
+	flag.Parse()
+	if *validate {
+		problems := server.Validate("data", *debugAddress)
+		for _, p := range problems {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", p)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Broker configuration is valid")
+		return
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	logger, err := zap.NewDevelopment()
@@ -18,11 +51,107 @@ func main() {
 		log.Panicf("Error creating logger: %v", err)
 	}
 	defer logger.Sync()
-	server, err := server.New(logger)
+	if *memoryLimit > 0 {
+		debug.SetMemoryLimit(*memoryLimit)
+	}
+	if *gcPercent != 0 {
+		debug.SetGCPercent(*gcPercent)
+	}
+	if *debugAddress != "" {
+		go func() {
+			logger.Info("Serving pprof", zap.String("address", *debugAddress))
+			err := http.ListenAndServe(*debugAddress, nil)
+			logger.Error("Stopped serving pprof", zap.Error(err))
+		}()
+	}
+	opts := []server.Option{}
+	for name, size := range maxMessageSizes {
+		opts = append(opts, server.WithValidators(name, partition.MaxMessageSize(size)))
+	}
+	for name, objective := range objectives {
+		opts = append(opts, server.WithSLO(name, objective))
+	}
+	server, err := server.New("data", logging.FromZap(logger), opts...)
 	if err != nil {
 		logger.Panic("Error creating server", zap.Error(err))
 	}
+	// served with pprof on the debug address
+	expvar.Publish("memory", expvar.Func(func() any {
+		return server.MemoryStats()
+	}))
+	expvar.Publish("process", expvar.Func(func() any {
+		return procstats.Sample()
+	}))
+	expvar.Publish("recordSizes", expvar.Func(func() any {
+		return server.RecordSizes()
+	}))
+	expvar.Publish("offsetGaps", expvar.Func(func() any {
+		return server.OffsetGaps()
+	}))
+	expvar.Publish("slo", expvar.Func(func() any {
+		return server.SLOs()
+	}))
 	go server.ListenAndAccept()
 	defer server.Close()
 	<-c
 }
+
+// maxMessageSizeFlag maps partition names to the largest message size they
+// accept
+type maxMessageSizeFlag map[string]int
+
+func (f maxMessageSizeFlag) String() string {
+	sizes := []string{}
+	for name, size := range f {
+		sizes = append(sizes, fmt.Sprintf("%s=%d", name, size))
+	}
+	return strings.Join(sizes, ",")
+}
+
+func (f maxMessageSizeFlag) Set(value string) error {
+	name, size, found := strings.Cut(value, "=")
+	if !found || name == "" {
+		return fmt.Errorf("expected partition=bytes, got %s", value)
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %s", size)
+	}
+	f[name] = n
+	return nil
+}
+
+// sloFlag maps partition names to their latency objective
+type sloFlag map[string]slo.Objective
+
+func (f sloFlag) String() string {
+	objectives := []string{}
+	for name, o := range f {
+		objectives = append(objectives, fmt.Sprintf("%s=%s:%v", name, o.Latency, o.Target))
+	}
+	return strings.Join(objectives, ",")
+}
+
+func (f sloFlag) Set(value string) error {
+	name, objective, found := strings.Cut(value, "=")
+	latency, target, foundTarget := strings.Cut(objective, ":")
+	if !found || !foundTarget || name == "" {
+		return fmt.Errorf("expected partition=latency:target, got %s", value)
+	}
+	var o slo.Objective
+	var err error
+	o.Latency, err = time.ParseDuration(latency)
+	if err != nil {
+		return fmt.Errorf("invalid latency %s: %v", latency, err)
+	}
+	o.Target, err = strconv.ParseFloat(target, 64)
+	if err != nil {
+		return fmt.Errorf("invalid target %s: %v", target, err)
+	}
+	err = o.Validate()
+	if err != nil {
+		return err
+	}
+	f[name] = o
+	return nil
+}
@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	sampleInterval = 100 * time.Millisecond
+	// the monitor enters degrade mode above the high and leaves it below the
+	// low share of the memory limit
+	pressureHigh = 0.9
+	pressureLow  = 0.8
+)
+
+type Stats struct {
+	// math.MaxInt64 if no memory limit is set
+	Limit int64
+	// memory the runtime counts against the limit
+	Used          uint64
+	UnderPressure bool
+}
+
+// Monitor samples the memory the go runtime accounts against the memory
+// limit set with GOMEMLIMIT or debug.SetMemoryLimit and reports pressure
+// when getting close to it
+type Monitor struct {
+	used     atomic.Uint64
+	limit    atomic.Int64
+	pressure atomic.Bool
+	samples  []metrics.Sample
+	quit     chan int
+	logger   *zap.Logger
+}
+
+func NewMonitor(logger *zap.Logger) *Monitor {
+	m := &Monitor{
+		samples: []metrics.Sample{
+			{Name: "/memory/classes/total:bytes"},
+			{Name: "/memory/classes/heap/released:bytes"},
+		},
+		quit:   make(chan int),
+		logger: logger,
+	}
+	m.sample()
+	go m.run()
+	return m
+}
+
+// UnderPressure is true while memory use is close to the limit, callers
+// should avoid large allocations then
+func (m *Monitor) UnderPressure() bool {
+	return m.pressure.Load()
+}
+
+func (m *Monitor) Stats() Stats {
+	return Stats{
+		Limit:         m.limit.Load(),
+		Used:          m.used.Load(),
+		UnderPressure: m.pressure.Load(),
+	}
+}
+
+func (m *Monitor) Close() {
+	close(m.quit)
+}
+
+func (m *Monitor) run() {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.sample()
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *Monitor) sample() {
+	metrics.Read(m.samples)
+	used := m.samples[0].Value.Uint64() - m.samples[1].Value.Uint64()
+	// a negative input only reads the limit
+	limit := debug.SetMemoryLimit(-1)
+	m.used.Store(used)
+	m.limit.Store(limit)
+	if limit == math.MaxInt64 {
+		m.pressure.Store(false)
+		return
+	}
+	share := float64(used) / float64(limit)
+	if !m.pressure.Load() && share >= pressureHigh {
+		m.logger.Warn("Memory use close to limit, entering degrade mode", zap.Uint64("used", used), zap.Int64("limit", limit))
+		m.pressure.Store(true)
+	} else if m.pressure.Load() && share < pressureLow {
+		m.logger.Info("Memory use back to normal, leaving degrade mode", zap.Uint64("used", used), zap.Int64("limit", limit))
+		m.pressure.Store(false)
+	}
+}
@@ -0,0 +1,69 @@
+package messages
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BatchIterator decodes the messages of a batch lazily. A batch is encoded
+// as (Message Length + Message) * n. Decoding doesn't allocate, messages are
+// returned as views into the batch
+type BatchIterator struct {
+	batch   []byte
+	offset  int
+	message []byte
+	err     error
+}
+
+func NewBatchIterator(batch []byte) *BatchIterator {
+	it := &BatchIterator{}
+	it.Reset(batch)
+	return it
+}
+
+// Reset starts iterating over a new batch, so one iterator can be reused for
+// many batches
+func (it *BatchIterator) Reset(batch []byte) {
+	it.batch = batch
+	it.offset = 0
+	it.message = nil
+	it.err = nil
+}
+
+// Next advances to the next message and returns false at the end of the
+// batch or if the batch is malformed
+func (it *BatchIterator) Next() bool {
+	if it.err != nil || it.offset == len(it.batch) {
+		it.message = nil
+		return false
+	}
+	rest := it.batch[it.offset:]
+	if len(rest) < 4 {
+		it.err = fmt.Errorf("couldn't read 4 bytes encoding message length at offset %d, only %d bytes left", it.offset, len(rest))
+		it.message = nil
+		return false
+	}
+	// compared as uint64, the length doesn't fit an int on 32 bit platforms
+	messageLength := uint64(binary.BigEndian.Uint32(rest))
+	if uint64(len(rest)-4) < messageLength {
+		it.err = fmt.Errorf("couldn't read message of length %d at offset %d, only %d bytes left", messageLength, it.offset, len(rest)-4)
+		it.message = nil
+		return false
+	}
+	it.message = rest[4 : 4+int(messageLength)]
+	it.offset += 4 + int(messageLength)
+	return true
+}
+
+// Message returns the current message. It stays valid as long as the batch
+// isn't modified, callers that keep messages longer need to copy them into
+// their own buffers
+func (it *BatchIterator) Message() []byte {
+	return it.message
+}
+
+// Err returns the error that stopped the iteration, nil at the end of a well
+// formed batch
+func (it *BatchIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,67 @@
+package messages
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func testBatch(messages int, size int) []byte {
+	batch := make([]byte, 0, messages*(4+size))
+	for i := 0; i < messages; i++ {
+		batch = binary.BigEndian.AppendUint32(batch, uint32(size))
+		batch = append(batch, make([]byte, size)...)
+	}
+	return batch
+}
+
+func TestBatchIteratorDoesNotAllocate(t *testing.T) {
+	batch := testBatch(100, 64)
+	it := NewBatchIterator(nil)
+	allocs := testing.AllocsPerRun(100, func() {
+		it.Reset(batch)
+		for it.Next() {
+			_ = it.Message()
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("expected no allocations, got %v per batch", allocs)
+	}
+	if it.Err() != nil {
+		t.Fatalf("unexpected error: %v", it.Err())
+	}
+}
+
+func TestBatchIteratorMalformed(t *testing.T) {
+	batches := map[string][]byte{
+		"truncated length":       {0, 0, 1},
+		"truncated message":      {0, 0, 0, 5, 1, 2},
+		"length above int32 max": {0x80, 0, 0, 0, 1, 2, 3},
+		"maximum length":         {0xff, 0xff, 0xff, 0xff, 1},
+		"second message broken":  append(testBatch(1, 3), 0, 0, 0, 9),
+	}
+	for name, batch := range batches {
+		it := NewBatchIterator(batch)
+		for it.Next() {
+		}
+		if it.Err() == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if it.Message() != nil {
+			t.Errorf("%s: expected no message after the error", name)
+		}
+	}
+}
+
+func BenchmarkBatchIterator(b *testing.B) {
+	batch := testBatch(100, 64)
+	it := NewBatchIterator(nil)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it.Reset(batch)
+		for it.Next() {
+			_ = it.Message()
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package messages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FlagCompressed is set in the type byte of frames whose payload after the
+// correlation id is gzip compressed. Frames are only compressed for
+// connections that asked for it
+const FlagCompressed byte = 0x80
+
+// CodecGzip is the only supported codec
+const CodecGzip = "gzip"
+
+// frames below this size aren't worth compressing
+const MinCompressedFrameLen = 1024
+
+const frameHeaderLen = 4 + 1 + 8
+
+// CompressFrame compresses the payload of a complete frame including its
+// length. It returns the frame unchanged if that isn't smaller
+func CompressFrame(frame []byte) ([]byte, error) {
+	if len(frame) < frameHeaderLen {
+		return nil, fmt.Errorf("frame too short to contain header")
+	}
+	var compressed bytes.Buffer
+	compressed.Write(frame[:frameHeaderLen])
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(frame[frameHeaderLen:])
+	if err != nil {
+		return nil, fmt.Errorf("error compressing frame: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error compressing frame: %v", err)
+	}
+	if compressed.Len() >= len(frame) {
+		return frame, nil
+	}
+	b := compressed.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	b[4] |= FlagCompressed
+	return b, nil
+}
+
+// Decompress restores a message as returned by ProtocolMessage if it was
+// compressed and returns it unchanged otherwise
+func Decompress(message []byte) ([]byte, error) {
+	if len(message) == 0 || message[0]&FlagCompressed == 0 {
+		return message, nil
+	}
+	if len(message) < 1+8 {
+		return nil, fmt.Errorf("compressed message too short to contain header")
+	}
+	r, err := gzip.NewReader(bytes.NewReader(message[1+8:]))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %v", err)
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing message: %v", err)
+	}
+	decompressed := make([]byte, 0, 1+8+len(payload))
+	decompressed = append(decompressed, message[0]&^FlagCompressed)
+	decompressed = append(decompressed, message[1:1+8]...)
+	return append(decompressed, payload...), nil
+}
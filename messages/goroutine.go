@@ -1,12 +1,66 @@
 package messages
 
+import "time"
+
 type ProduceRequest struct {
 	ProduceAck chan ProduceAck
-	BatchId    uint64
-	Payload    []byte
+	// closed when the connection waiting for the ack is gone
+	ConnectionQuit <-chan int
+	CorrelationId  uint64
+	BatchId        uint64
+	Payload        []byte
+	// when the broker finished reading the request from the connection
+	Received time.Time
 }
 
 type ProduceAck struct {
+	CorrelationId uint64
 	BatchId       uint64
 	PartitionName string
+	Latency       ProduceLatency
+	// how long the broker asks the producer to hold back further batches,
+	// 0 if it isn't under load
+	Throttle time.Duration
+	// set if the batch couldn't be produced, the broker responds with an
+	// error instead of an ack
+	Err error
+}
+
+// ProduceLatency breaks down where a batch spent its time until it was
+// acknowledged. The broker fills in BrokerQueue and Append, the producer the
+// rest
+type ProduceLatency struct {
+	ClientQueue time.Duration
+	Network     time.Duration
+	BrokerQueue time.Duration
+	Append      time.Duration
+}
+
+type ErrorResponse struct {
+	CorrelationId uint64
+	Message       string
+}
+
+type PartitionOffsets struct {
+	LogStart      uint64
+	HighWatermark uint64
+	LastStable    uint64
+}
+
+// SampledRecord is a persisted message read back for debugging. Payload is
+// truncated if it's shorter than Size
+type SampledRecord struct {
+	Offset  uint64
+	Size    uint32
+	Payload []byte
+}
+
+// ClientInfo describes a connected client. The client reports everything
+// but Remote and Connected after connecting, it's empty until then
+type ClientInfo struct {
+	Remote         string
+	ClientId       string
+	LibraryVersion string
+	Host           string
+	Connected      time.Time
 }
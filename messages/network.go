@@ -62,13 +62,16 @@ func protocolMessageLength(reader io.Reader, logger *zap.Logger) (uint32, error)
 
 func NextString(protocolMessage []byte, logger *zap.Logger) (string, int, error) {
 	var stringLength uint16
-	err := binary.Read(bytes.NewReader(protocolMessage[:2]), binary.BigEndian, &stringLength)
+	err := binary.Read(bytes.NewReader(protocolMessage), binary.BigEndian, &stringLength)
 	if err != nil {
 		return "", 0, fmt.Errorf("error reading length of string: %v", err)
 	}
 	logger.Debug("Reading string of length", zap.Uint16("stringLength", stringLength))
-	endOfString := stringLength + 2
-	return string(protocolMessage[2:endOfString]), int(endOfString), nil
+	endOfString := int(stringLength) + 2
+	if endOfString > len(protocolMessage) {
+		return "", 0, fmt.Errorf("string of length %d exceeds the remaining %d bytes", stringLength, len(protocolMessage)-2)
+	}
+	return string(protocolMessage[2:endOfString]), endOfString, nil
 }
 
 func NextUInt64(protocolMessage []byte) (uint64, int, error) {
@@ -1,34 +1,77 @@
 package partition
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math/bits"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/lthiede/cartero/clock"
 	"github.com/lthiede/cartero/messages"
+	"github.com/lthiede/cartero/slo"
 	"go.uber.org/zap"
 )
 
+// MaxSampleRecords is the number of most recent messages that can be sampled
+const MaxSampleRecords = 1024
+
 type Partition struct {
 	Name    string
 	Input   chan messages.ProduceRequest
 	storage *os.File
-	quit    chan int
-	logger  *zap.Logger
+	frozen  atomic.Bool
+	// offset of the next message, messages are numbered from 0 since the
+	// storage file is recreated on start
+	highWatermark atomic.Uint64
+	iterator      *messages.BatchIterator
+	// file positions of the most recent messages, indexed by offset modulo
+	// MaxSampleRecords. recentEnd is the offset after the last position
+	recentPositions []int64
+	recentEnd       uint64
+	written         int64
+	lastSize        uint32
+	recentLock      sync.Mutex
+	// receives a channel for the result of syncing the storage file once
+	// all earlier batches are written
+	syncs chan chan error
+	// number of batches after which the storage file didn't match the
+	// recorded positions, this should always be 0
+	gaps atomic.Uint64
+	// persisted messages by bits.Len32 of their size, bucket i counts sizes
+	// below 1<<i
+	recordSizes [33]atomic.Uint64
+	clock       clock.Clock
+	validators  []Validator
+	// nil if the partition has no latency objective
+	slo    *slo.Tracker
+	quit   chan int
+	logger *zap.Logger
 }
 
-func New(name string, logger *zap.Logger) (*Partition, error) {
+func New(name string, dir string, c clock.Clock, validators []Validator, tracker *slo.Tracker, logger *zap.Logger) (*Partition, error) {
 	logger.Info("Creating new partition", zap.String("partition", name))
-	file, err := os.Create(fmt.Sprintf("data/%s", name))
+	file, err := os.Create(filepath.Join(dir, name))
 	if err != nil {
 		return nil, fmt.Errorf("error creating the storage file: %v", err)
 	}
 	logger.Debug("Created file", zap.String("partition", name), zap.String("file", file.Name()))
 	return &Partition{
-		name,
-		make(chan messages.ProduceRequest),
-		file,
-		make(chan int),
-		logger,
+		Name:            name,
+		Input:           make(chan messages.ProduceRequest),
+		storage:         file,
+		iterator:        messages.NewBatchIterator(nil),
+		recentPositions: make([]int64, MaxSampleRecords),
+		syncs:           make(chan chan error),
+		clock:           c,
+		validators:      validators,
+		slo:             tracker,
+		quit:            make(chan int),
+		logger:          logger,
 	}, nil
 }
 
@@ -37,17 +80,46 @@ func (p *Partition) HandleProduce() {
 	for {
 		select {
 		case pr := <-p.Input:
-			p.logger.Info("Persisting batch", zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId))
+			dequeued := p.clock.Now()
+			if p.frozen.Load() {
+				p.reject(pr, fmt.Errorf("partition %s is frozen, produce rejected", p.Name))
+				continue
+			}
+			numberMessages, err := p.countMessages(pr.Payload)
+			if err != nil {
+				p.reject(pr, fmt.Errorf("malformed batch: %v", err))
+				continue
+			}
+			err = p.validate(pr.Payload)
+			if err != nil {
+				p.reject(pr, fmt.Errorf("invalid batch: %v", err))
+				continue
+			}
+			p.logger.Info("Persisting batch", zap.Uint64("correlationId", pr.CorrelationId), zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId))
 			n, err := p.storage.Write(pr.Payload)
 			if err != nil {
-				p.logger.Error("Failed to write batch to file", zap.Int("numberBytesWritten", n), zap.Int("numberBytesTotal", len(pr.Payload)), zap.Error(err))
-				p.Close()
+				p.logger.Error("Failed to write batch to file", zap.Uint64("correlationId", pr.CorrelationId), zap.Int("numberBytesWritten", n), zap.Int("numberBytesTotal", len(pr.Payload)), zap.Error(err))
+				p.discardPartialWrite()
+				p.fail(pr, fmt.Errorf("error writing batch to partition %s: %v", p.Name, err))
+				continue
+			}
+			p.remember(pr.Payload)
+			p.highWatermark.Add(numberMessages)
+			p.checkContinuity(pr)
+			p.logger.Info("Successfully persisted batch", zap.Uint64("correlationId", pr.CorrelationId), zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId))
+			latency := messages.ProduceLatency{
+				BrokerQueue: dequeued.Sub(pr.Received),
+				Append:      p.clock.Since(dequeued),
 			}
-			p.logger.Info("Successfully persisted batch", zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId))
-			pr.ProduceAck <- messages.ProduceAck{
+			p.recordSLO(latency.BrokerQueue+latency.Append, false)
+			p.ack(pr, messages.ProduceAck{
+				CorrelationId: pr.CorrelationId,
 				BatchId:       pr.BatchId,
 				PartitionName: p.Name,
-			}
+				Latency:       latency,
+			})
+		case done := <-p.syncs:
+			done <- p.storage.Sync()
 		case <-p.quit:
 			p.logger.Info("Stop handling produce", zap.String("partition", p.Name))
 			return
@@ -55,6 +127,237 @@ func (p *Partition) HandleProduce() {
 	}
 }
 
+// discardPartialWrite cuts the storage file back to the end of the last
+// persisted batch, so later batches start at a message boundary
+func (p *Partition) discardPartialWrite() {
+	err := p.storage.Truncate(p.written)
+	if err == nil {
+		_, err = p.storage.Seek(p.written, io.SeekStart)
+	}
+	if err != nil {
+		p.logger.Error("Error discarding partially written batch", zap.String("partition", p.Name), zap.Int64("filePosition", p.written), zap.Error(err))
+	}
+}
+
+func (p *Partition) countMessages(batch []byte) (uint64, error) {
+	p.iterator.Reset(batch)
+	var n uint64
+	for p.iterator.Next() {
+		n++
+	}
+	return n, p.iterator.Err()
+}
+
+// remember records the file positions of the messages of a persisted batch
+func (p *Partition) remember(batch []byte) {
+	p.recentLock.Lock()
+	defer p.recentLock.Unlock()
+	position := p.written
+	p.iterator.Reset(batch)
+	for p.iterator.Next() {
+		size := len(p.iterator.Message())
+		p.recentPositions[p.recentEnd%MaxSampleRecords] = position
+		p.lastSize = uint32(size)
+		p.recentEnd++
+		p.recordSizes[bits.Len32(uint32(size))].Add(1)
+		position += 4 + int64(size)
+	}
+	p.written += int64(len(batch))
+}
+
+// checkContinuity compares the recorded positions with the storage file
+// itself: the file has to end where the last message does and the length
+// prefix at the last message's position has to be its size. This catches
+// positions that drifted from what was written, e.g. after partial writes
+// or writes by other processes, which sampling would read garbage from
+func (p *Partition) checkContinuity(pr messages.ProduceRequest) {
+	p.recentLock.Lock()
+	persisted := p.recentEnd
+	written := p.written
+	lastSize := p.lastSize
+	var lastPosition int64
+	if persisted > 0 {
+		lastPosition = p.recentPositions[(persisted-1)%MaxSampleRecords]
+	}
+	p.recentLock.Unlock()
+	info, err := p.storage.Stat()
+	if err != nil {
+		p.logger.Error("Error reading storage file size", zap.String("partition", p.Name), zap.Error(err))
+		return
+	}
+	fields := []zap.Field{
+		zap.String("partition", p.Name),
+		zap.Uint64("correlationId", pr.CorrelationId),
+		zap.Uint64("batchId", pr.BatchId),
+		zap.Int64("expectedFileSize", written),
+		zap.Int64("fileSize", info.Size()),
+	}
+	if info.Size() == written {
+		if persisted == 0 {
+			return
+		}
+		var length [4]byte
+		_, err = p.storage.ReadAt(length[:], lastPosition)
+		if err != nil {
+			p.logger.Error("Error reading length of last message", zap.String("partition", p.Name), zap.Int64("filePosition", lastPosition), zap.Error(err))
+			return
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size == lastSize {
+			return
+		}
+		fields = append(fields, zap.Int64("lastMessagePosition", lastPosition), zap.Uint32("expectedLastMessageSize", lastSize), zap.Uint32("lastMessageSize", size))
+	}
+	p.gaps.Add(1)
+	p.logger.Error("Storage file doesn't match the recorded message positions", append(fields, zap.Uint64("gaps", p.gaps.Load()))...)
+}
+
+// Gaps returns the number of batches after which the storage file didn't
+// match the recorded message positions
+func (p *Partition) Gaps() uint64 {
+	return p.gaps.Load()
+}
+
+// RecordSizes returns the number of persisted messages by size, keyed by
+// the exclusive upper bound of the bucket. Empty buckets are left out
+func (p *Partition) RecordSizes() map[string]uint64 {
+	sizes := map[string]uint64{}
+	for i := range p.recordSizes {
+		count := p.recordSizes[i].Load()
+		if count > 0 {
+			sizes[fmt.Sprintf("<%d", uint64(1)<<i)] = count
+		}
+	}
+	return sizes
+}
+
+// Sample reads back up to n of the most recent messages, oldest first.
+// Payloads are truncated to maxBytes unless maxBytes is 0
+func (p *Partition) Sample(n int, maxBytes int) ([]messages.SampledRecord, error) {
+	if n > MaxSampleRecords {
+		n = MaxSampleRecords
+	}
+	p.recentLock.Lock()
+	end := p.recentEnd
+	if uint64(n) > end {
+		n = int(end)
+	}
+	positions := make([]int64, n)
+	for i := range positions {
+		positions[i] = p.recentPositions[(end-uint64(n)+uint64(i))%MaxSampleRecords]
+	}
+	p.recentLock.Unlock()
+	records := make([]messages.SampledRecord, 0, n)
+	for i, position := range positions {
+		var length [4]byte
+		_, err := p.storage.ReadAt(length[:], position)
+		if err != nil {
+			return nil, fmt.Errorf("error reading message length at position %d: %v", position, err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		payloadLen := int(size)
+		if maxBytes > 0 && payloadLen > maxBytes {
+			payloadLen = maxBytes
+		}
+		payload := make([]byte, payloadLen)
+		_, err = p.storage.ReadAt(payload, position+4)
+		if err != nil {
+			return nil, fmt.Errorf("error reading message at position %d: %v", position, err)
+		}
+		records = append(records, messages.SampledRecord{
+			Offset:  end - uint64(n) + uint64(i),
+			Size:    size,
+			Payload: payload,
+		})
+	}
+	return records, nil
+}
+
+// recordSLO counts a batch towards the latency objective. Only batches the
+// broker persisted or failed to persist are counted. Malformed and invalid
+// batches are the producer's fault and produces to frozen partitions are
+// rejected during planned maintenance
+func (p *Partition) recordSLO(latency time.Duration, failed bool) {
+	if p.slo != nil {
+		p.slo.Record(latency, failed)
+	}
+}
+
+// SLO reports compliance with the latency objective, ok is false if the
+// partition has none
+func (p *Partition) SLO() (report slo.Report, ok bool) {
+	if p.slo == nil {
+		return slo.Report{}, false
+	}
+	return p.slo.Report(), true
+}
+
+func (p *Partition) reject(pr messages.ProduceRequest, err error) {
+	p.logger.Info("Rejecting batch", zap.Uint64("correlationId", pr.CorrelationId), zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId), zap.Error(err))
+	p.ack(pr, messages.ProduceAck{
+		CorrelationId: pr.CorrelationId,
+		BatchId:       pr.BatchId,
+		PartitionName: p.Name,
+		Err:           err,
+	})
+}
+
+// fail rejects a batch the broker couldn't persist, unlike other rejections
+// it counts against the latency objective
+func (p *Partition) fail(pr messages.ProduceRequest, err error) {
+	p.reject(pr, err)
+	p.recordSLO(0, true)
+}
+
+func (p *Partition) ack(pr messages.ProduceRequest, ack messages.ProduceAck) {
+	select {
+	case pr.ProduceAck <- ack:
+	case <-pr.ConnectionQuit:
+		p.logger.Info("Dropping ack for closed connection", zap.Uint64("correlationId", pr.CorrelationId), zap.String("partition", p.Name), zap.Uint64("batchId", pr.BatchId))
+	}
+}
+
+// SetFrozen freezes or unfreezes the partition. Produces to a frozen
+// partition are rejected
+func (p *Partition) SetFrozen(frozen bool) {
+	p.logger.Info("Setting partition frozen", zap.String("partition", p.Name), zap.Bool("frozen", frozen))
+	p.frozen.Store(frozen)
+}
+
+// Handoff freezes the partition and returns once every acked batch is synced
+// to disk, so the broker can be stopped for maintenance without losing acked
+// data. Batches still queued are rejected like for any frozen partition
+func (p *Partition) Handoff() error {
+	p.logger.Info("Handing off partition", zap.String("partition", p.Name))
+	p.SetFrozen(true)
+	done := make(chan error, 1)
+	select {
+	case p.syncs <- done:
+	case <-p.quit:
+		return fmt.Errorf("partition %s is closed", p.Name)
+	}
+	err := <-done
+	if err != nil {
+		return fmt.Errorf("error syncing storage file: %v", err)
+	}
+	return nil
+}
+
+func (p *Partition) Frozen() bool {
+	return p.frozen.Load()
+}
+
+// Offsets is cheap to call and doesn't wait for batches being persisted
+func (p *Partition) Offsets() messages.PartitionOffsets {
+	highWatermark := p.highWatermark.Load()
+	return messages.PartitionOffsets{
+		LogStart:      0,
+		HighWatermark: highWatermark,
+		// there are no transactions, so every persisted message is stable
+		LastStable: highWatermark,
+	}
+}
+
 func (p *Partition) Close() error {
 	p.logger.Debug("Closing partition", zap.String("partition", p.Name))
 	close(p.quit)
@@ -0,0 +1,41 @@
+package partition
+
+import "fmt"
+
+// Validator checks every message of a batch before it's appended. An error
+// rejects the whole batch and is returned to the producer
+type Validator interface {
+	Name() string
+	Validate(message []byte) error
+}
+
+// MaxMessageSize rejects messages larger than the given number of bytes
+type MaxMessageSize int
+
+func (m MaxMessageSize) Name() string {
+	return "max-message-size"
+}
+
+func (m MaxMessageSize) Validate(message []byte) error {
+	if len(message) > int(m) {
+		return fmt.Errorf("message has %d bytes, at most %d are allowed", len(message), int(m))
+	}
+	return nil
+}
+
+// validate runs the validators on every message of the batch
+func (p *Partition) validate(batch []byte) error {
+	if len(p.validators) == 0 {
+		return nil
+	}
+	p.iterator.Reset(batch)
+	for i := 0; p.iterator.Next(); i++ {
+		for _, v := range p.validators {
+			err := v.Validate(p.iterator.Message())
+			if err != nil {
+				return fmt.Errorf("message %d rejected by validator %s: %v", i, v.Name(), err)
+			}
+		}
+	}
+	return nil
+}
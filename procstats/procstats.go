@@ -0,0 +1,17 @@
+package procstats
+
+import "runtime"
+
+// Stats is a snapshot of resources held by the current process. Fields the
+// platform can't report are 0
+type Stats struct {
+	RSS        uint64 `json:"rss"`
+	Goroutines int    `json:"goroutines"`
+	OpenFiles  int    `json:"openFiles"`
+}
+
+func Sample() Stats {
+	s := Stats{Goroutines: runtime.NumGoroutine()}
+	s.RSS, s.OpenFiles = sampleOS()
+	return s
+}
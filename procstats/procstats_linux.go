@@ -0,0 +1,35 @@
+//go:build linux
+
+package procstats
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func sampleOS() (uint64, int) {
+	var rss uint64
+	status, err := os.Open("/proc/self/status")
+	if err == nil {
+		scanner := bufio.NewScanner(status)
+		for scanner.Scan() {
+			// VmRSS:	   12345 kB
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 3 && fields[0] == "VmRSS:" {
+				kb, err := strconv.ParseUint(fields[1], 10, 64)
+				if err == nil {
+					rss = kb * 1024
+				}
+				break
+			}
+		}
+		status.Close()
+	}
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return rss, 0
+	}
+	return rss, len(fds)
+}
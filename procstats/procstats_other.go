@@ -0,0 +1,7 @@
+//go:build !linux
+
+package procstats
+
+func sampleOS() (uint64, int) {
+	return 0, 0
+}
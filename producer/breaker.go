@@ -0,0 +1,103 @@
+package producer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+)
+
+// a dial that hangs has to count as a failure too
+const breakerDialTimeout = 5 * time.Second
+
+// ErrCircuitOpen is returned by Breaker.Dial while the broker endpoint is
+// considered down
+var ErrCircuitOpen = errors.New("circuit open, broker endpoint failed recently")
+
+// Breaker dials a broker endpoint and fails fast for a cooldown after a
+// number of consecutive failures instead of piling up doomed attempts. After
+// the cooldown a single probe dial is let through, the circuit closes if it
+// succeeds and opens for another cooldown if it fails
+type Breaker struct {
+	address   string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	openUntil time.Time
+	// a probe dial after the cooldown is in progress
+	probing bool
+	clock   clock.Clock
+	lock    sync.Mutex
+}
+
+func NewBreaker(address string, threshold int, cooldown time.Duration, c clock.Clock) *Breaker {
+	return &Breaker{
+		address:   address,
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     c,
+	}
+}
+
+// Dial connects to the endpoint unless the circuit is open. Failed dials
+// count towards opening the circuit, callers can report later failures on
+// the connection with Failure, or pass the breaker to WithBreaker
+func (b *Breaker) Dial() (net.Conn, error) {
+	b.lock.Lock()
+	if b.open {
+		if b.probing || b.clock.Now().Before(b.openUntil) {
+			b.lock.Unlock()
+			return nil, ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	b.lock.Unlock()
+	conn, err := net.DialTimeout("tcp", b.address, breakerDialTimeout)
+	if err != nil {
+		b.Failure()
+		return nil, fmt.Errorf("error dialing %s: %v", b.address, err)
+	}
+	b.Success()
+	return conn, nil
+}
+
+// Failure records a failure and opens the circuit once the threshold of
+// consecutive failures is reached. A failed probe opens it again right away
+func (b *Breaker) Failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.open {
+		if b.probing {
+			b.openUntil = b.clock.Now().Add(b.cooldown)
+			b.probing = false
+		}
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open = true
+		b.openUntil = b.clock.Now().Add(b.cooldown)
+		b.failures = 0
+	}
+}
+
+// Success closes the circuit and resets the consecutive failures
+func (b *Breaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.open = false
+	b.probing = false
+	b.failures = 0
+}
+
+// Open is true while dials fail fast, during the cooldown and while a probe
+// is in progress
+func (b *Breaker) Open() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.open && (b.probing || b.clock.Now().Before(b.openUntil))
+}
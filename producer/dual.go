@@ -0,0 +1,253 @@
+package producer
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/messages"
+	"go.uber.org/zap"
+)
+
+const (
+	shadowQueueSize = 1024
+	// batches still missing a response after this are given up on
+	outcomeTimeout = time.Minute
+	// the oldest batches are given up on beyond this many
+	maxPendingOutcomes = 64 * 1024
+)
+
+var errShadowDropped = errors.New("batch dropped, the shadow's queue was full")
+
+type DualMetrics struct {
+	Primary Metrics
+	Shadow  Metrics
+	// batches the shadow couldn't keep up with, they were never sent to it
+	ShadowDropped uint64
+	// batches with responses from both, by whether the responses agreed
+	Matched  uint64
+	Diverged uint64
+	// batches given up on because a response didn't arrive in time
+	Expired uint64
+	// batches still waiting for the response of one side
+	Pending int
+}
+
+type batchKey struct {
+	partition string
+	batchId   uint64
+}
+
+type dualOutcome struct {
+	created     time.Time
+	primaryDone bool
+	primaryErr  error
+	shadowDone  bool
+	shadowErr   error
+}
+
+// pendingOutcome remembers when an outcome was created, so the outcomes
+// can be expired oldest first
+type pendingOutcome struct {
+	key     batchKey
+	created time.Time
+}
+
+type shadowBatch struct {
+	partition string
+	batchId   uint64
+	batch     [][]byte
+}
+
+// Dual writes every batch to a primary and a shadow producer, e.g. to
+// migrate onto another cluster without a hard cutover. Only the primary's
+// acks and errors are delivered. The shadow is written asynchronously, so
+// it can't slow down or fail producing, and its acks are compared to the
+// primary's. Both producers have to use ModeAcked, NewDual returns an error
+// otherwise
+type Dual struct {
+	primary  *Producer
+	shadow   *Producer
+	acks     chan messages.ProduceAck
+	shadowed chan shadowBatch
+	outcomes map[batchKey]*dualOutcome
+	// in creation order, may contain outcomes that are already complete
+	pending []pendingOutcome
+	// counted under outcomesLock
+	shadowDropped uint64
+	matched       uint64
+	diverged      uint64
+	expired       uint64
+	outcomesLock  sync.Mutex
+	shadowDone    chan int
+	quit          chan int
+	wg            sync.WaitGroup
+	logger        *zap.Logger
+}
+
+func NewDual(primary *Producer, shadow *Producer) (*Dual, error) {
+	if primary.mode != ModeAcked || shadow.mode != ModeAcked {
+		return nil, errors.New("primary and shadow have to use ModeAcked")
+	}
+	d := &Dual{
+		primary:    primary,
+		shadow:     shadow,
+		acks:       make(chan messages.ProduceAck),
+		shadowed:   make(chan shadowBatch, shadowQueueSize),
+		outcomes:   map[batchKey]*dualOutcome{},
+		shadowDone: make(chan int),
+		quit:       make(chan int),
+		logger:     primary.logger,
+	}
+	d.wg.Add(2)
+	go d.receivePrimaryAcks()
+	go d.receiveShadowAcks()
+	go d.sendShadowed()
+	return d, nil
+}
+
+// Produce sends the batch to the primary like Producer.Produce and queues a
+// copy for the shadow. The copy is dropped if the shadow's queue is full
+func (d *Dual) Produce(partition string, batchId uint64, batch [][]byte) error {
+	key := batchKey{partition, batchId}
+	now := d.primary.clock.Now()
+	d.outcomesLock.Lock()
+	d.expireLocked(now)
+	d.outcomes[key] = &dualOutcome{created: now}
+	d.pending = append(d.pending, pendingOutcome{key, now})
+	d.outcomesLock.Unlock()
+	err := d.primary.Produce(partition, batchId, batch)
+	if err != nil {
+		d.outcomesLock.Lock()
+		delete(d.outcomes, key)
+		d.outcomesLock.Unlock()
+		return err
+	}
+	shadowed := shadowBatch{partition, batchId, make([][]byte, len(batch))}
+	for i, m := range batch {
+		shadowed.batch[i] = append([]byte(nil), m...)
+	}
+	select {
+	case d.shadowed <- shadowed:
+	default:
+		d.outcomesLock.Lock()
+		d.shadowDropped++
+		d.recordLocked(key, false, errShadowDropped)
+		d.outcomesLock.Unlock()
+	}
+	return nil
+}
+
+// Acks delivers the primary's acks, see Producer.Acks
+func (d *Dual) Acks() <-chan messages.ProduceAck {
+	return d.acks
+}
+
+func (d *Dual) Metrics() DualMetrics {
+	d.outcomesLock.Lock()
+	defer d.outcomesLock.Unlock()
+	return DualMetrics{
+		Primary:       d.primary.Metrics(),
+		Shadow:        d.shadow.Metrics(),
+		ShadowDropped: d.shadowDropped,
+		Matched:       d.matched,
+		Diverged:      d.diverged,
+		Expired:       d.expired,
+		Pending:       len(d.outcomes),
+	}
+}
+
+// Close sends the queued shadow batches and closes both producers
+func (d *Dual) Close() error {
+	close(d.shadowed)
+	<-d.shadowDone
+	shadowErr := d.shadow.Close()
+	err := d.primary.Close()
+	close(d.quit)
+	d.wg.Wait()
+	if err != nil {
+		return err
+	}
+	return shadowErr
+}
+
+func (d *Dual) sendShadowed() {
+	defer close(d.shadowDone)
+	for b := range d.shadowed {
+		err := d.shadow.Produce(b.partition, b.batchId, b.batch)
+		if err != nil {
+			d.logger.Debug("Error producing to shadow", zap.String("partition", b.partition), zap.Uint64("batchId", b.batchId), zap.Error(err))
+			d.outcomesLock.Lock()
+			d.recordLocked(batchKey{b.partition, b.batchId}, false, err)
+			d.outcomesLock.Unlock()
+		}
+	}
+}
+
+func (d *Dual) receivePrimaryAcks() {
+	defer d.wg.Done()
+	defer close(d.acks)
+	for ack := range d.primary.Acks() {
+		d.outcomesLock.Lock()
+		d.recordLocked(batchKey{ack.PartitionName, ack.BatchId}, true, ack.Err)
+		d.outcomesLock.Unlock()
+		select {
+		case d.acks <- ack:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *Dual) receiveShadowAcks() {
+	defer d.wg.Done()
+	for ack := range d.shadow.Acks() {
+		d.outcomesLock.Lock()
+		d.recordLocked(batchKey{ack.PartitionName, ack.BatchId}, false, ack.Err)
+		d.outcomesLock.Unlock()
+	}
+}
+
+// expireLocked gives up on the outcomes older than outcomeTimeout and on
+// the oldest outcomes beyond maxPendingOutcomes
+func (d *Dual) expireLocked(now time.Time) {
+	for len(d.pending) > 0 {
+		oldest := d.pending[0]
+		outcome, ok := d.outcomes[oldest.key]
+		if ok && outcome.created.Equal(oldest.created) {
+			if now.Sub(oldest.created) < outcomeTimeout && len(d.outcomes) < maxPendingOutcomes {
+				return
+			}
+			delete(d.outcomes, oldest.key)
+			d.expired++
+			d.logger.Warn("Gave up waiting for responses of primary and shadow", zap.String("partition", oldest.key.partition), zap.Uint64("batchId", oldest.key.batchId), zap.Bool("primaryDone", outcome.primaryDone), zap.Bool("shadowDone", outcome.shadowDone))
+		}
+		d.pending = d.pending[1:]
+	}
+}
+
+// recordLocked notes one side's response and compares both once they are
+// complete. Batches the shadow never got count as diverged
+func (d *Dual) recordLocked(key batchKey, primary bool, err error) {
+	outcome, ok := d.outcomes[key]
+	if !ok {
+		return
+	}
+	if primary {
+		outcome.primaryDone = true
+		outcome.primaryErr = err
+	} else {
+		outcome.shadowDone = true
+		outcome.shadowErr = err
+	}
+	if !outcome.primaryDone || !outcome.shadowDone {
+		return
+	}
+	delete(d.outcomes, key)
+	if (outcome.primaryErr == nil) == (outcome.shadowErr == nil) {
+		d.matched++
+		return
+	}
+	d.diverged++
+	d.logger.Warn("Primary and shadow diverged", zap.String("partition", key.partition), zap.Uint64("batchId", key.batchId), zap.NamedError("primaryError", outcome.primaryErr), zap.NamedError("shadowError", outcome.shadowErr))
+}
@@ -0,0 +1,14 @@
+package producer
+
+import "github.com/lthiede/cartero/messages"
+
+// Interceptor hooks into the produce path, e.g. for auditing, encryption or
+// custom metrics. Interceptors are called in the order they were added with
+// WithInterceptors
+type Interceptor interface {
+	// BeforeSend is called before a batch is encoded and can replace its
+	// messages. Returning an error aborts producing the batch
+	BeforeSend(partition string, batchId uint64, batch [][]byte) ([][]byte, error)
+	// AfterAck is called for every ack received from the broker
+	AfterAck(ack messages.ProduceAck)
+}
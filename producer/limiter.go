@@ -0,0 +1,98 @@
+package producer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+)
+
+const (
+	// the rate never drops below this share of the limit
+	minRateShare = 0.01
+	// share of the limit the rate recovers per second without hints
+	recoveryPerSecond = 0.1
+)
+
+// limiter paces batches and adapts to the broker's throttle hints. A hint
+// delays the next batch by the hint and halves the rate. Hints arriving
+// before the delay passed belong to the same episode, usually acks of
+// batches that were already in flight, and don't halve the rate again.
+// Once the hints stop, the rate recovers by a tenth of the limit per
+// second. Without a limit only the delays are followed
+type limiter struct {
+	// batches per second, 0 if there's no limit
+	limit float64
+	rate  float64
+	next  time.Time
+	// end of the current throttle episode
+	throttledUntil time.Time
+	// the rate recovered until here
+	recovered time.Time
+	clock     clock.Clock
+	lock      sync.Mutex
+}
+
+func newLimiter(limit float64, c clock.Clock) *limiter {
+	return &limiter{
+		limit: limit,
+		rate:  limit,
+		clock: c,
+	}
+}
+
+// wait blocks until the next batch may be sent
+func (l *limiter) wait() {
+	l.lock.Lock()
+	now := l.clock.Now()
+	send := now
+	if l.next.After(now) {
+		send = l.next
+	}
+	l.next = send
+	if l.rate > 0 {
+		l.next = send.Add(time.Duration(float64(time.Second) / l.rate))
+	}
+	l.lock.Unlock()
+	if send.After(now) {
+		<-l.clock.After(send.Sub(now))
+	}
+}
+
+func (l *limiter) feedback(throttle time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	if throttle <= 0 {
+		if l.limit > 0 && now.After(l.recovered) {
+			l.rate += l.limit * recoveryPerSecond * now.Sub(l.recovered).Seconds()
+			if l.rate > l.limit {
+				l.rate = l.limit
+			}
+			l.recovered = now
+		}
+		return
+	}
+	resume := now.Add(throttle)
+	if resume.After(l.next) {
+		l.next = resume
+	}
+	if l.limit > 0 && !now.Before(l.throttledUntil) {
+		l.rate = l.rate / 2
+		if l.rate < l.limit*minRateShare {
+			l.rate = l.limit * minRateShare
+		}
+	}
+	if resume.After(l.throttledUntil) {
+		l.throttledUntil = resume
+	}
+	l.recovered = l.throttledUntil
+}
+
+// currentRate returns the batches per second currently allowed, 0 if
+// there's no limit
+func (l *limiter) currentRate() float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
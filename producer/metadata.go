@@ -0,0 +1,55 @@
+package producer
+
+import (
+	"encoding/binary"
+	"os"
+	"runtime/debug"
+
+	"github.com/lthiede/cartero/connection"
+	"go.uber.org/zap"
+)
+
+const modulePath = "github.com/lthiede/cartero"
+
+// sendMetadata tells the broker who is connected, so operators can find the
+// producer in the broker's list of clients
+func (p *Producer) sendMetadata() {
+	host, err := os.Hostname()
+	if err != nil {
+		p.logger.Warn("Error reading host name", zap.Error(err))
+	}
+	fields := []string{p.clientId, libraryVersion(), host}
+	requestLen := 1 + 8
+	for _, f := range fields {
+		requestLen += 2 + len(f)
+	}
+	request := make([]byte, 0, 4+requestLen)
+	request = binary.BigEndian.AppendUint32(request, uint32(requestLen))
+	request = append(request, connection.RequestTypeClientMetadata)
+	p.handshakeCorrelationId = p.correlationIds.Add(1)
+	request = binary.BigEndian.AppendUint64(request, p.handshakeCorrelationId)
+	for _, f := range fields {
+		request = binary.BigEndian.AppendUint16(request, uint16(len(f)))
+		request = append(request, []byte(f)...)
+	}
+	_, err = p.conn.Write(request)
+	if err != nil {
+		p.logger.Warn("Error sending client metadata", zap.Error(err))
+	}
+}
+
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,62 @@
+package producer
+
+import (
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/logging"
+)
+
+type Option func(*Producer)
+
+// WithMode sets the delivery mode, the default is ModeAcked
+func WithMode(mode Mode) Option {
+	return func(p *Producer) {
+		p.mode = mode
+	}
+}
+
+// WithLogger sets the logger, the default discards all logs
+func WithLogger(logger logging.Logger) Option {
+	return func(p *Producer) {
+		p.logger = logging.Zap(logger)
+	}
+}
+
+// WithClock sets the time source for latency measurements, the default is
+// the system clock
+func WithClock(c clock.Clock) Option {
+	return func(p *Producer) {
+		p.clock = c
+	}
+}
+
+// WithClientId sets the id the broker lists the producer's connection
+// under, together with the library version and host
+func WithClientId(id string) Option {
+	return func(p *Producer) {
+		p.clientId = id
+	}
+}
+
+// WithInterceptors adds interceptors, they are called in the order they are
+// added
+func WithInterceptors(interceptors ...Interceptor) Option {
+	return func(p *Producer) {
+		p.interceptors = append(p.interceptors, interceptors...)
+	}
+}
+
+// WithRateLimit limits the batches sent per second. The producer slows down
+// further when the broker asks it to, the default is no limit
+func WithRateLimit(batchesPerSecond float64) Option {
+	return func(p *Producer) {
+		p.rateLimit = batchesPerSecond
+	}
+}
+
+// WithBreaker reports failures of the connection to the breaker it was
+// dialed with, so reconnects fail fast while the broker is down
+func WithBreaker(b *Breaker) Option {
+	return func(p *Producer) {
+		p.breaker = b
+	}
+}
@@ -0,0 +1,396 @@
+package producer
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/connection"
+	"github.com/lthiede/cartero/messages"
+	"go.uber.org/zap"
+)
+
+type Mode int
+
+const (
+	// ModeAcked writes every batch synchronously and delivers the acks
+	ModeAcked Mode = iota
+	// ModeFireAndForget never blocks or retries. Batches that can't be
+	// queued or written are dropped and counted instead
+	ModeFireAndForget
+)
+
+const fireAndForgetQueueSize = 1024
+
+type Metrics struct {
+	Sent    uint64
+	Dropped uint64
+	Acked   uint64
+	Failed  uint64
+	// acks asking the producer to slow down
+	Throttled uint64
+	// batches per second the limiter currently allows, 0 without a limit
+	Rate float64
+}
+
+type produceRequest struct {
+	correlationId uint64
+	partition     string
+	batchId       uint64
+	bytes         []byte
+	produced      time.Time
+}
+
+type inFlightBatch struct {
+	partition string
+	batchId   uint64
+	produced  time.Time
+	written   time.Time
+}
+
+type Producer struct {
+	conn           net.Conn
+	mode           Mode
+	requests       chan produceRequest
+	correlationIds atomic.Uint64
+	inFlight       map[uint64]inFlightBatch
+	inFlightLock   sync.Mutex
+	acks           chan messages.ProduceAck
+	sent           atomic.Uint64
+	dropped        atomic.Uint64
+	acked          atomic.Uint64
+	failed         atomic.Uint64
+	throttled      atomic.Uint64
+	rateLimit      float64
+	limiter        *limiter
+	// told once when the connection breaks, nil without WithBreaker
+	breaker      *Breaker
+	failedOnce   sync.Once
+	interceptors []Interceptor
+	clientId     string
+	clock        clock.Clock
+	// closed once the broker accepted the client metadata
+	handshake              chan int
+	handshakeCorrelationId uint64
+	done                   chan int
+	quit                   chan int
+	logger                 *zap.Logger
+}
+
+func New(conn net.Conn, opts ...Option) *Producer {
+	p := &Producer{
+		conn:      conn,
+		mode:      ModeAcked,
+		requests:  make(chan produceRequest, fireAndForgetQueueSize),
+		inFlight:  map[uint64]inFlightBatch{},
+		acks:      make(chan messages.ProduceAck),
+		done:      make(chan int),
+		quit:      make(chan int),
+		clock:     clock.System{},
+		handshake: make(chan int),
+		logger:    zap.NewNop(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.limiter = newLimiter(p.rateLimit, p.clock)
+	p.sendMetadata()
+	if p.mode == ModeFireAndForget {
+		go p.sendQueued()
+	} else {
+		close(p.done)
+	}
+	go p.receiveResponses()
+	return p
+}
+
+// Produce sends the messages as one batch. In fire and forget mode it
+// returns immediately and drops the batch if the send queue is full
+func (p *Producer) Produce(partition string, batchId uint64, batch [][]byte) error {
+	produced := p.clock.Now()
+	for _, i := range p.interceptors {
+		var err error
+		batch, err = i.BeforeSend(partition, batchId, batch)
+		if err != nil {
+			return fmt.Errorf("interceptor rejected batch %d for partition %s: %v", batchId, partition, err)
+		}
+	}
+	correlationId := p.correlationIds.Add(1)
+	request := produceRequest{
+		correlationId: correlationId,
+		partition:     partition,
+		batchId:       batchId,
+		bytes:         encodeProduceRequest(correlationId, partition, batchId, batch),
+		produced:      produced,
+	}
+	if p.mode == ModeFireAndForget {
+		select {
+		case p.requests <- request:
+		default:
+			p.dropped.Add(1)
+			p.logger.Debug("Dropped batch", zap.Uint64("correlationId", correlationId), zap.String("partition", partition), zap.Uint64("batchId", batchId))
+		}
+		return nil
+	}
+	return p.send(request)
+}
+
+// Warm waits until the broker answered the client metadata the producer
+// sends when it's created. After a round trip the connection is fully set
+// up, so the first batches don't pay for it
+func (p *Producer) Warm(timeout time.Duration) error {
+	select {
+	case <-p.handshake:
+		return nil
+	case <-p.clock.After(timeout):
+		return fmt.Errorf("broker didn't answer the client metadata within %v", timeout)
+	}
+}
+
+// Acks delivers the acks of produced batches, including batches the broker
+// responded to with an error. It isn't used in fire and forget mode and is
+// closed once the connection stops delivering responses
+func (p *Producer) Acks() <-chan messages.ProduceAck {
+	return p.acks
+}
+
+func (p *Producer) Metrics() Metrics {
+	return Metrics{
+		Sent:      p.sent.Load(),
+		Dropped:   p.dropped.Load(),
+		Acked:     p.acked.Load(),
+		Failed:    p.failed.Load(),
+		Throttled: p.throttled.Load(),
+		Rate:      p.limiter.currentRate(),
+	}
+}
+
+func (p *Producer) Close() error {
+	p.logger.Debug("Closing producer")
+	if p.mode == ModeFireAndForget {
+		close(p.requests)
+	}
+	<-p.done
+	close(p.quit)
+	return p.conn.Close()
+}
+
+func (p *Producer) sendQueued() {
+	defer close(p.done)
+	for request := range p.requests {
+		err := p.send(request)
+		if err != nil {
+			p.dropped.Add(1)
+			p.logger.Debug("Dropped batch", zap.Uint64("correlationId", request.correlationId), zap.Error(err))
+		}
+	}
+}
+
+func (p *Producer) send(request produceRequest) error {
+	p.limiter.wait()
+	if p.logger.Level() == zap.DebugLevel {
+		hasher := sha1.New()
+		hasher.Write(request.bytes[4:])
+		sha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
+		p.logger.Debug("Write request", zap.Uint64("correlationId", request.correlationId), zap.String("sha", sha), zap.ByteString("request", request.bytes))
+	}
+	p.inFlightLock.Lock()
+	p.inFlight[request.correlationId] = inFlightBatch{
+		partition: request.partition,
+		batchId:   request.batchId,
+		produced:  request.produced,
+		written:   p.clock.Now(),
+	}
+	p.inFlightLock.Unlock()
+	n, err := p.conn.Write(request.bytes)
+	if err != nil {
+		p.inFlightLock.Lock()
+		delete(p.inFlight, request.correlationId)
+		p.inFlightLock.Unlock()
+		p.connectionFailed()
+		return fmt.Errorf("error writing request %d to connection, wrote %d of %d bytes: %v", request.correlationId, n, len(request.bytes), err)
+	}
+	p.sent.Add(1)
+	return nil
+}
+
+func (p *Producer) receiveResponses() {
+	defer close(p.acks)
+	for {
+		response, err := messages.ProtocolMessage(p.conn, p.logger)
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				p.logger.Error("Error reading response", zap.Error(err))
+				p.connectionFailed()
+			}
+			return
+		}
+		received := p.clock.Now()
+		if len(response) >= 1+8 && response[0] == connection.ResponseTypeOk {
+			correlationId, _, _ := messages.NextUInt64(response[1:])
+			if correlationId == p.handshakeCorrelationId {
+				close(p.handshake)
+			}
+			continue
+		}
+		ack, err := parseResponse(response, p.logger)
+		if err != nil {
+			p.logger.Error("Error parsing response", zap.Error(err))
+			return
+		}
+		p.complete(&ack, received)
+		p.limiter.feedback(ack.Throttle)
+		if ack.Throttle > 0 {
+			p.throttled.Add(1)
+		}
+		if ack.Err != nil {
+			p.failed.Add(1)
+			p.logger.Error("Broker failed to produce batch", zap.Uint64("correlationId", ack.CorrelationId), zap.String("partition", ack.PartitionName), zap.Uint64("batchId", ack.BatchId), zap.Error(ack.Err))
+			if p.mode == ModeFireAndForget {
+				p.dropped.Add(1)
+			}
+		} else {
+			p.acked.Add(1)
+		}
+		for _, i := range p.interceptors {
+			i.AfterAck(ack)
+		}
+		if p.mode == ModeFireAndForget {
+			continue
+		}
+		select {
+		case p.acks <- ack:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// connectionFailed reports the broken connection to the breaker, once even
+// if both writing and reading fail
+func (p *Producer) connectionFailed() {
+	if p.breaker == nil {
+		return
+	}
+	p.failedOnce.Do(p.breaker.Failure)
+}
+
+// complete matches the response to its batch and adds the client side
+// latency
+func (p *Producer) complete(ack *messages.ProduceAck, received time.Time) {
+	p.inFlightLock.Lock()
+	batch, ok := p.inFlight[ack.CorrelationId]
+	delete(p.inFlight, ack.CorrelationId)
+	p.inFlightLock.Unlock()
+	if !ok {
+		p.logger.Warn("Received response for unknown request", zap.Uint64("correlationId", ack.CorrelationId))
+		return
+	}
+	ack.PartitionName = batch.partition
+	ack.BatchId = batch.batchId
+	ack.Latency.ClientQueue = batch.written.Sub(batch.produced)
+	network := received.Sub(batch.written) - ack.Latency.BrokerQueue - ack.Latency.Append
+	if network > 0 {
+		ack.Latency.Network = network
+	}
+}
+
+func encodeProduceRequest(correlationId uint64, partition string, batchId uint64, batch [][]byte) []byte {
+	payloadLen := 0
+	for _, m := range batch {
+		payloadLen += 4 + len(m)
+	}
+	partitionNameLen := 2 + len(partition)
+	requestLengthEncodingLen := 4
+	requestTypeEncodingLen := 1
+	correlationIdEncodingLen := 8
+	batchIdEncodingLen := 8
+	requestLen := requestTypeEncodingLen + correlationIdEncodingLen + partitionNameLen + batchIdEncodingLen + payloadLen
+	request := make([]byte, 0, requestLen+requestLengthEncodingLen)
+	request = binary.BigEndian.AppendUint32(request, uint32(requestLen))
+	request = append(request, connection.RequestTypeProduce)
+	request = binary.BigEndian.AppendUint64(request, correlationId)
+	request = binary.BigEndian.AppendUint16(request, uint16(len(partition)))
+	request = append(request, []byte(partition)...)
+	request = binary.BigEndian.AppendUint64(request, batchId)
+	for _, m := range batch {
+		request = binary.BigEndian.AppendUint32(request, uint32(len(m)))
+		request = append(request, m...)
+	}
+	return request
+}
+
+func parseResponse(response []byte, logger *zap.Logger) (messages.ProduceAck, error) {
+	if len(response) < 1+8 {
+		return messages.ProduceAck{}, fmt.Errorf("response too short to contain header")
+	}
+	correlationId, _, err := messages.NextUInt64(response[1:])
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing correlation id: %v", err)
+	}
+	switch response[0] {
+	case connection.ResponseTypeAckProduce:
+		ack, err := parseAck(response[1+8:], logger)
+		if err != nil {
+			return messages.ProduceAck{}, fmt.Errorf("error parsing ack of request %d: %v", correlationId, err)
+		}
+		ack.CorrelationId = correlationId
+		return ack, nil
+	case connection.ResponseTypeError:
+		message, _, err := messages.NextString(response[1+8:], logger)
+		if err != nil {
+			return messages.ProduceAck{}, fmt.Errorf("error parsing error message of request %d: %v", correlationId, err)
+		}
+		return messages.ProduceAck{
+			CorrelationId: correlationId,
+			Err:           errors.New(message),
+		}, nil
+	default:
+		return messages.ProduceAck{}, fmt.Errorf("received unrecognized response type %v", response[0])
+	}
+}
+
+func parseAck(response []byte, logger *zap.Logger) (messages.ProduceAck, error) {
+	partition, bytesUsed, err := messages.NextString(response, logger)
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing partition name: %v", err)
+	}
+	bytesUsedTotal := bytesUsed
+	batchId, bytesUsed, err := messages.NextUInt64(response[bytesUsedTotal:])
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing batch id: %v", err)
+	}
+	bytesUsedTotal += bytesUsed
+	brokerQueue, bytesUsed, err := messages.NextUInt64(response[bytesUsedTotal:])
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing broker queueing time: %v", err)
+	}
+	bytesUsedTotal += bytesUsed
+	appendTime, bytesUsed, err := messages.NextUInt64(response[bytesUsedTotal:])
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing append time: %v", err)
+	}
+	bytesUsedTotal += bytesUsed
+	throttle, _, err := messages.NextUInt64(response[bytesUsedTotal:])
+	if err != nil {
+		return messages.ProduceAck{}, fmt.Errorf("error parsing throttle time: %v", err)
+	}
+	return messages.ProduceAck{
+		BatchId:       batchId,
+		PartitionName: partition,
+		Latency: messages.ProduceLatency{
+			BrokerQueue: time.Duration(brokerQueue),
+			Append:      time.Duration(appendTime),
+		},
+		Throttle: time.Duration(throttle),
+	}, nil
+}
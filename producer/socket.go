@@ -0,0 +1,24 @@
+package producer
+
+import (
+	"errors"
+	"time"
+)
+
+// SocketStats are taken from the kernel's view of the connection and help
+// to tell network problems apart from a slow broker
+type SocketStats struct {
+	RTT         time.Duration
+	RTTVar      time.Duration
+	Retransmits uint32
+	// congestion window in segments
+	CongestionWindow uint32
+}
+
+var errSocketStatsUnsupported = errors.New("socket stats are not supported for this connection")
+
+// SocketStats returns the current tcp statistics of the connection. It must
+// be called before the producer is closed
+func (p *Producer) SocketStats() (SocketStats, error) {
+	return socketStats(p.conn)
+}
@@ -0,0 +1,43 @@
+//go:build linux && !386
+
+package producer
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func socketStats(conn net.Conn) (SocketStats, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return SocketStats{}, errSocketStatsUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return SocketStats{}, fmt.Errorf("error accessing socket: %v", err)
+	}
+	var info syscall.TCPInfo
+	var sockoptErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockoptErr = errno
+		}
+	})
+	if err != nil {
+		return SocketStats{}, fmt.Errorf("error accessing socket: %v", err)
+	}
+	if sockoptErr != nil {
+		return SocketStats{}, fmt.Errorf("error reading TCP_INFO: %v", sockoptErr)
+	}
+	return SocketStats{
+		RTT:              time.Duration(info.Rtt) * time.Microsecond,
+		RTTVar:           time.Duration(info.Rttvar) * time.Microsecond,
+		Retransmits:      info.Total_retrans,
+		CongestionWindow: info.Snd_cwnd,
+	}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux || 386
+
+package producer
+
+import "net"
+
+func socketStats(conn net.Conn) (SocketStats, error) {
+	return SocketStats{}, errSocketStatsUnsupported
+}
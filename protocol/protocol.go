@@ -0,0 +1,223 @@
+// Package protocol loads the machine readable wire protocol definition in
+// protocol.json and encodes and decodes messages according to it. It's
+// independent of the hand written encoding in the broker and the producer,
+// so it can be used to check both against the definition
+package protocol
+
+import (
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+//go:embed protocol.json
+var definition []byte
+
+type Field struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type Message struct {
+	Name   string  `json:"name"`
+	Type   byte    `json:"type"`
+	Fields []Field `json:"fields"`
+	// names of the responses a request can be answered with
+	Responses []string `json:"responses,omitempty"`
+}
+
+type Spec struct {
+	Framing   string            `json:"framing"`
+	Types     map[string]string `json:"types"`
+	Requests  []Message         `json:"requests"`
+	Responses []Message         `json:"responses"`
+}
+
+func Load() (*Spec, error) {
+	spec := &Spec{}
+	err := json.Unmarshal(definition, spec)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing protocol definition: %v", err)
+	}
+	for _, messages := range [][]Message{spec.Requests, spec.Responses} {
+		for _, m := range messages {
+			for _, f := range m.Fields {
+				if _, ok := spec.Types[f.Type]; !ok {
+					return nil, fmt.Errorf("field %s of %s has undefined type %s", f.Name, m.Name, f.Type)
+				}
+			}
+		}
+	}
+	return spec, nil
+}
+
+func (s *Spec) Request(name string) (*Message, error) {
+	return find(s.Requests, name)
+}
+
+func (s *Spec) Response(name string) (*Message, error) {
+	return find(s.Responses, name)
+}
+
+func (s *Spec) ResponseOfType(t byte) (*Message, error) {
+	for i := range s.Responses {
+		if s.Responses[i].Type == t {
+			return &s.Responses[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no response of type %d", t)
+}
+
+func find(messages []Message, name string) (*Message, error) {
+	for i := range messages {
+		if messages[i].Name == name {
+			return &messages[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no message %s", name)
+}
+
+// Encode returns the framed message. Values are uint8, uint16, uint32 and
+// uint64 for the integer types, string for strings and [][]byte for batches
+func (m *Message) Encode(values map[string]any) ([]byte, error) {
+	message := []byte{m.Type}
+	for _, f := range m.Fields {
+		v, ok := values[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing field %s of %s", f.Name, m.Name)
+		}
+		var err error
+		message, err = appendField(message, f, v)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s of %s: %v", f.Name, m.Name, err)
+		}
+	}
+	framed := make([]byte, 0, 4+len(message))
+	framed = binary.BigEndian.AppendUint32(framed, uint32(len(message)))
+	return append(framed, message...), nil
+}
+
+func appendField(b []byte, f Field, v any) ([]byte, error) {
+	wrongType := fmt.Errorf("value %v doesn't fit type %s", v, f.Type)
+	switch f.Type {
+	case "uint8":
+		i, ok := v.(uint8)
+		if !ok {
+			return nil, wrongType
+		}
+		return append(b, i), nil
+	case "uint16":
+		i, ok := v.(uint16)
+		if !ok {
+			return nil, wrongType
+		}
+		return binary.BigEndian.AppendUint16(b, i), nil
+	case "uint32":
+		i, ok := v.(uint32)
+		if !ok {
+			return nil, wrongType
+		}
+		return binary.BigEndian.AppendUint32(b, i), nil
+	case "uint64":
+		i, ok := v.(uint64)
+		if !ok {
+			return nil, wrongType
+		}
+		return binary.BigEndian.AppendUint64(b, i), nil
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return nil, wrongType
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+		return append(b, []byte(s)...), nil
+	case "batch":
+		batch, ok := v.([][]byte)
+		if !ok {
+			return nil, wrongType
+		}
+		for _, m := range batch {
+			b = binary.BigEndian.AppendUint32(b, uint32(len(m)))
+			b = append(b, m...)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", f.Type)
+	}
+}
+
+// Decode parses an unframed message starting with its type byte. It fails
+// if the message doesn't match the definition exactly, including trailing
+// bytes
+func (m *Message) Decode(message []byte) (map[string]any, error) {
+	if len(message) == 0 || message[0] != m.Type {
+		return nil, fmt.Errorf("message isn't of type %d", m.Type)
+	}
+	values := map[string]any{}
+	rest := message[1:]
+	for _, f := range m.Fields {
+		v, n, err := nextField(rest, f)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s of %s: %v", f.Name, m.Name, err)
+		}
+		values[f.Name] = v
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after %s", len(rest), m.Name)
+	}
+	return values, nil
+}
+
+func nextField(b []byte, f Field) (any, int, error) {
+	tooShort := fmt.Errorf("only %d bytes left for type %s", len(b), f.Type)
+	switch f.Type {
+	case "uint8":
+		if len(b) < 1 {
+			return nil, 0, tooShort
+		}
+		return b[0], 1, nil
+	case "uint16":
+		if len(b) < 2 {
+			return nil, 0, tooShort
+		}
+		return binary.BigEndian.Uint16(b), 2, nil
+	case "uint32":
+		if len(b) < 4 {
+			return nil, 0, tooShort
+		}
+		return binary.BigEndian.Uint32(b), 4, nil
+	case "uint64":
+		if len(b) < 8 {
+			return nil, 0, tooShort
+		}
+		return binary.BigEndian.Uint64(b), 8, nil
+	case "string":
+		if len(b) < 2 {
+			return nil, 0, tooShort
+		}
+		length := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+length {
+			return nil, 0, tooShort
+		}
+		return string(b[2 : 2+length]), 2 + length, nil
+	case "batch":
+		batch := [][]byte{}
+		n := 0
+		for n < len(b) {
+			if len(b)-n < 4 {
+				return nil, 0, tooShort
+			}
+			length := int(binary.BigEndian.Uint32(b[n:]))
+			if len(b)-n-4 < length {
+				return nil, 0, tooShort
+			}
+			batch = append(batch, b[n+4:n+4+length])
+			n += 4 + length
+		}
+		return batch, n, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown type %s", f.Type)
+	}
+}
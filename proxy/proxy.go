@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/logging"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	// address the proxied connections are forwarded to
+	Target string
+	// added to every chunk of data in both directions, plus a random share
+	// of up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+	// bytes per second in each direction of a connection, 0 for unlimited
+	Bandwidth int
+	// reset a connection after it forwarded this many bytes, 0 to never
+	ResetAfter int
+}
+
+// Proxy forwards tcp connections to the target while injecting latency,
+// bandwidth limits and connection resets. It's meant for testing how clients
+// cope with a bad network
+type Proxy struct {
+	listener net.Listener
+	config   Config
+	conns    map[net.Conn]struct{}
+	connLock sync.Mutex
+	quit     chan int
+	logger   *zap.Logger
+}
+
+type chunk struct {
+	bytes     []byte
+	deliverAt time.Time
+}
+
+// New starts a proxy listening on address, e.g. localhost:0 to pick a free
+// port
+func New(address string, config Config, l logging.Logger) (*Proxy, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %v", address, err)
+	}
+	p := &Proxy{
+		listener: listener,
+		config:   config,
+		conns:    map[net.Conn]struct{}{},
+		quit:     make(chan int),
+		logger:   logging.Zap(l),
+	}
+	go p.accept()
+	return p, nil
+}
+
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Reset resets all open connections
+func (p *Proxy) Reset() {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	for c := range p.conns {
+		reset(c)
+	}
+}
+
+func (p *Proxy) Close() error {
+	close(p.quit)
+	err := p.listener.Close()
+	p.Reset()
+	return err
+}
+
+func (p *Proxy) accept() {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.quit:
+				p.logger.Info("Stop proxying connections")
+				return
+			default:
+			}
+			p.logger.Error("Error accepting connection", zap.Error(err))
+			continue
+		}
+		target, err := net.Dial("tcp", p.config.Target)
+		if err != nil {
+			p.logger.Error("Error dialing target", zap.String("target", p.config.Target), zap.Error(err))
+			reset(client)
+			continue
+		}
+		p.logger.Info("Proxying new connection", zap.String("client", client.RemoteAddr().String()), zap.String("target", p.config.Target))
+		p.track(client, target)
+		var forwarded sync.Mutex
+		total := 0
+		count := func(n int) bool {
+			forwarded.Lock()
+			defer forwarded.Unlock()
+			total += n
+			return p.config.ResetAfter > 0 && total >= p.config.ResetAfter
+		}
+		go p.forward(target, client, count)
+		go p.forward(client, target, count)
+	}
+}
+
+func (p *Proxy) track(conns ...net.Conn) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	for _, c := range conns {
+		p.conns[c] = struct{}{}
+	}
+}
+
+func (p *Proxy) untrack(conns ...net.Conn) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	for _, c := range conns {
+		delete(p.conns, c)
+	}
+}
+
+// forward copies src to dst with the configured delay and bandwidth. It
+// closes both connections when either side fails. count is called with
+// the number of forwarded bytes and returns true to reset the connection
+func (p *Proxy) forward(dst net.Conn, src net.Conn, count func(int) bool) {
+	chunks := make(chan chunk, 1024)
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				delay := p.config.Latency
+				if p.config.Jitter > 0 {
+					delay += time.Duration(rand.Int63n(int64(p.config.Jitter)))
+				}
+				chunks <- chunk{buf[:n], time.Now().Add(delay)}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	for c := range chunks {
+		time.Sleep(time.Until(c.deliverAt))
+		_, err := dst.Write(c.bytes)
+		if err != nil {
+			break
+		}
+		if p.config.Bandwidth > 0 {
+			time.Sleep(time.Duration(len(c.bytes)) * time.Second / time.Duration(p.config.Bandwidth))
+		}
+		if count(len(c.bytes)) {
+			p.logger.Info("Resetting connection", zap.String("address", src.RemoteAddr().String()))
+			reset(src)
+			reset(dst)
+			break
+		}
+	}
+	src.Close()
+	dst.Close()
+	p.untrack(src, dst)
+	for range chunks {
+	}
+}
+
+// reset closes the connection with a RST instead of a FIN
+func reset(c net.Conn) {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	c.Close()
+}
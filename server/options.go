@@ -0,0 +1,33 @@
+package server
+
+import (
+	"github.com/lthiede/cartero/clock"
+	"github.com/lthiede/cartero/partition"
+	"github.com/lthiede/cartero/slo"
+)
+
+type Option func(*Server)
+
+// WithClock sets the time source for latency measurements, the default is
+// the system clock
+func WithClock(c clock.Clock) Option {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// WithValidators adds validators for the messages produced to a partition.
+// They run in the order they were added
+func WithValidators(partitionName string, validators ...partition.Validator) Option {
+	return func(s *Server) {
+		s.validators[partitionName] = append(s.validators[partitionName], validators...)
+	}
+}
+
+// WithSLO tracks the latency objective of a partition, compliance and burn
+// rates are reported by SLOs
+func WithSLO(partitionName string, objective slo.Objective) Option {
+	return func(s *Server) {
+		s.objectives[partitionName] = objective
+	}
+}
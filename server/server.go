@@ -4,64 +4,150 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"path/filepath"
 
+	"github.com/lthiede/cartero/audit"
+	"github.com/lthiede/cartero/clock"
 	"github.com/lthiede/cartero/connection"
+	"github.com/lthiede/cartero/logging"
+	"github.com/lthiede/cartero/memory"
 	"github.com/lthiede/cartero/partition"
+	"github.com/lthiede/cartero/slo"
 	"go.uber.org/zap"
 )
 
+const address = "localhost:8080"
+
 type Server struct {
-	partitions map[string]partition.Partition
+	partitions map[string]*partition.Partition
+	audit      *audit.Log
+	memory     *memory.Monitor
+	clients    *connection.Clients
+	clock      clock.Clock
+	validators map[string][]partition.Validator
+	objectives map[string]slo.Objective
 	quit       chan int
 	logger     *zap.Logger
 }
 
-func New(logger *zap.Logger) (*Server, error) {
-	logger.Info("Creating new server")
-	partitions := map[string]partition.Partition{}
+// New creates a server storing partitions and the audit log in dataDir
+func New(dataDir string, l logging.Logger, opts ...Option) (*Server, error) {
+	logger := logging.Zap(l)
+	s := &Server{
+		clients:    connection.NewClients(),
+		clock:      clock.System{},
+		validators: map[string][]partition.Validator{},
+		objectives: map[string]slo.Objective{},
+		quit:       make(chan int),
+		logger:     logger,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	logger.Info("Creating new server", zap.String("dataDir", dataDir))
+	auditLog, err := audit.New(filepath.Join(dataDir, "audit"), s.clock, logger)
+	if err != nil {
+		return nil, fmt.Errorf("error creating audit log: %v", err)
+	}
+	partitions := map[string]*partition.Partition{}
 	for i := 0; i <= 3; i++ {
 		name := fmt.Sprintf("partition%d", i)
-		p, err := partition.New(name, logger)
+		var tracker *slo.Tracker
+		if objective, ok := s.objectives[name]; ok {
+			tracker = slo.NewTracker(objective, s.clock)
+		}
+		p, err := partition.New(name, dataDir, s.clock, s.validators[name], tracker, logger)
+		event := audit.Event{
+			Operation: audit.OperationCreatePartition,
+			Partition: name,
+			Success:   err == nil,
+		}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		auditLog.Record(event)
 		if err != nil {
 			return nil, fmt.Errorf("error creating partition %s: %v", name, err)
 		}
 		go p.HandleProduce()
-		partitions[name] = *p
+		partitions[name] = p
 	}
-	return &Server{
-		partitions,
-		make(chan int),
-		logger,
-	}, nil
+	s.partitions = partitions
+	s.audit = auditLog
+	s.memory = memory.NewMonitor(logger)
+	return s, nil
 }
 
 func (s *Server) ListenAndAccept() {
-	l, err := net.Listen("tcp", "localhost:8080")
+	l, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	s.logger.Info("Accepting connections on localhost:8080")
-	defer l.Close()
+	s.logger.Info("Accepting connections", zap.String("address", address))
+	s.Serve(l)
+}
+
+// Serve accepts connections from l until the server is closed. This allows
+// serving in process listeners in addition to tcp
+func (s *Server) Serve(l net.Listener) {
+	go func() {
+		<-s.quit
+		l.Close()
+	}()
 	for {
-		select {
-		case <-s.quit:
-			s.logger.Info("Stop accepting connections")
-			return
-		default:
-			c, err := l.Accept()
-			if err != nil {
-				log.Println(err)
-				continue
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				s.logger.Info("Stop accepting connections")
+				return
+			default:
 			}
-			s.logger.Info("Accepted new connection")
-			conn := connection.New(c, s.partitions, s.logger)
-			go conn.HandleRequests()
-			defer conn.Close()
+			log.Println(err)
+			continue
 		}
+		s.logger.Info("Accepted new connection")
+		conn := connection.New(c, s.partitions, s.audit, s.memory, s.clients, s.clock, s.logger)
+		go conn.HandleRequests()
+		defer conn.Close()
 	}
 }
 
+func (s *Server) MemoryStats() memory.Stats {
+	return s.memory.Stats()
+}
+
+// RecordSizes returns the record size histogram of every partition
+func (s *Server) RecordSizes() map[string]map[string]uint64 {
+	sizes := map[string]map[string]uint64{}
+	for name, p := range s.partitions {
+		sizes[name] = p.RecordSizes()
+	}
+	return sizes
+}
+
+// SLOs reports compliance with the latency objectives of the partitions
+// that have one
+func (s *Server) SLOs() map[string]slo.Report {
+	reports := map[string]slo.Report{}
+	for name, p := range s.partitions {
+		if report, ok := p.SLO(); ok {
+			reports[name] = report
+		}
+	}
+	return reports
+}
+
+// OffsetGaps returns the number of continuity violations per partition
+func (s *Server) OffsetGaps() map[string]uint64 {
+	gaps := map[string]uint64{}
+	for name, p := range s.partitions {
+		gaps[name] = p.Gaps()
+	}
+	return gaps
+}
+
 func (s *Server) Close() error {
 	s.logger.Debug("Closing server")
 	for name, p := range s.partitions {
@@ -70,6 +156,11 @@ func (s *Server) Close() error {
 			s.logger.Error("Error closing partition", zap.String("partition", name), zap.Error(err))
 		}
 	}
+	err := s.audit.Close()
+	if err != nil {
+		s.logger.Error("Error closing audit log", zap.Error(err))
+	}
+	s.memory.Close()
 	close(s.quit)
 	return nil
 }
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// the broker refuses to start with less free space in its data directory
+const minFreeBytes = 1 << 30
+
+var errFreeBytesUnsupported = errors.New("free space can't be determined on this platform")
+
+// Validate checks that a broker could start with dataDir and the given
+// debug address, empty if pprof isn't served. It returns every problem it
+// finds instead of stopping at the first
+func Validate(dataDir string, debugAddress string) []error {
+	problems := []error{}
+	err := checkDataDir(dataDir)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		free, err := freeBytes(dataDir)
+		switch {
+		case err == errFreeBytesUnsupported:
+			// free space can't be checked on this platform
+		case err != nil:
+			problems = append(problems, fmt.Errorf("can't determine free space in data directory %s: %v", dataDir, err))
+		case free < minFreeBytes:
+			problems = append(problems, fmt.Errorf("only %d bytes free in data directory %s, need at least %d", free, dataDir, minFreeBytes))
+		}
+	}
+	addresses := []string{address}
+	if debugAddress != "" {
+		addresses = append(addresses, debugAddress)
+	}
+	for _, a := range addresses {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("can't listen on %s: %v", a, err))
+			continue
+		}
+		l.Close()
+	}
+	return problems
+}
+
+func checkDataDir(dataDir string) error {
+	info, err := os.Stat(dataDir)
+	if err != nil {
+		return fmt.Errorf("data directory %s isn't accessible: %v", dataDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("data directory %s isn't a directory", dataDir)
+	}
+	probe, err := os.CreateTemp(dataDir, ".validate")
+	if err != nil {
+		return fmt.Errorf("data directory %s isn't writable: %v", dataDir, err)
+	}
+	probe.Close()
+	err = os.Remove(probe.Name())
+	if err != nil {
+		return fmt.Errorf("can't remove files in data directory %s: %v", dataDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin
+
+package server
+
+func freeBytes(dir string) (uint64, error) {
+	return 0, errFreeBytesUnsupported
+}
@@ -0,0 +1,120 @@
+package slo
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lthiede/cartero/clock"
+)
+
+// burn rates are computed over a short and a long window. Alerting when
+// both burn fast catches incidents quickly without paging on short spikes,
+// at 14.4 a 30 day budget is used up in about 2 days
+var windows = []time.Duration{5 * time.Minute, time.Hour}
+
+const alertBurnRate = 14.4
+
+// Objective is met by a batch that's appended within Latency. Target is the
+// share of batches that should meet it, e.g. 0.999
+type Objective struct {
+	Latency time.Duration
+	Target  float64
+}
+
+func (o Objective) Validate() error {
+	if o.Latency <= 0 {
+		return fmt.Errorf("latency objective must be positive, got %s", o.Latency)
+	}
+	if o.Target <= 0 || o.Target >= 1 {
+		return fmt.Errorf("target must be between 0 and 1 exclusively, got %v", o.Target)
+	}
+	return nil
+}
+
+type WindowReport struct {
+	Window time.Duration
+	Total  uint64
+	Good   uint64
+	// share of good batches, 1 if there were none
+	Compliance float64
+	// how fast the error budget is used up, 1 uses it up exactly at the
+	// end of the budget period
+	BurnRate float64
+}
+
+type Report struct {
+	Objective Objective
+	Windows   []WindowReport
+	// true while every window burns faster than the alert burn rate
+	Alert bool
+}
+
+type bucket struct {
+	second int64
+	total  uint64
+	good   uint64
+}
+
+// Tracker counts good and bad batches in one second buckets covering the
+// longest window
+type Tracker struct {
+	objective Objective
+	buckets   []bucket
+	clock     clock.Clock
+	lock      sync.Mutex
+}
+
+func NewTracker(objective Objective, c clock.Clock) *Tracker {
+	return &Tracker{
+		objective: objective,
+		buckets:   make([]bucket, int(windows[len(windows)-1]/time.Second)),
+		clock:     c,
+	}
+}
+
+// Record counts a batch. Batches that failed count against the objective
+// regardless of their latency
+func (t *Tracker) Record(latency time.Duration, failed bool) {
+	second := t.clock.Now().Unix()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	b := &t.buckets[second%int64(len(t.buckets))]
+	if b.second != second {
+		*b = bucket{second: second}
+	}
+	b.total++
+	if !failed && latency <= t.objective.Latency {
+		b.good++
+	}
+}
+
+func (t *Tracker) Report() Report {
+	now := t.clock.Now().Unix()
+	report := Report{
+		Objective: t.objective,
+		Windows:   make([]WindowReport, len(windows)),
+		Alert:     true,
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, window := range windows {
+		w := WindowReport{Window: window, Compliance: 1}
+		oldest := now - int64(window/time.Second)
+		for _, b := range t.buckets {
+			if b.second > oldest && b.second <= now {
+				w.Total += b.total
+				w.Good += b.good
+			}
+		}
+		if w.Total > 0 {
+			w.Compliance = float64(w.Good) / float64(w.Total)
+		}
+		w.BurnRate = (1 - w.Compliance) / (1 - t.objective.Target)
+		if w.BurnRate < alertBurnRate {
+			report.Alert = false
+		}
+		report.Windows[i] = w
+	}
+	return report
+}